@@ -5,66 +5,261 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptrace"
 	urllib "net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 )
 
-func buildHttpClient(wc *WrappedClient) *http.Client {
+func buildHttpClient(wc *WrappedClient, config *Config) *http.Client {
 	client := &http.Client{
-		Timeout:       wc.config.Timeout,
-		CheckRedirect: wc.config.CheckRedirect,
-		Jar:           wc.config.Jar,
-		Transport: &http.Transport{
-			TLSClientConfig: wc.tlsConfig,
-			DialContext: (&net.Dialer{
-				Resolver: wc.resolver,
-				Control:  buildRunFunc(wc),
-			}).DialContext,
-		},
+		Timeout:       config.Timeout,
+		CheckRedirect: buildCheckRedirectFunc(wc),
+		Jar:           config.Jar,
+		Transport:     buildTransport(wc, config),
 	}
 
 	return client
 }
 
-func buildRunFunc(wc *WrappedClient) func(network, address string, c syscall.RawConn) error {
-	return func(network, address string, _ syscall.RawConn) error {
-		wc.log(fmt.Sprintf("connection to address: %v", address))
+// buildTransport returns a new http.Transport, or a clone of
+// config.BaseTransport, dialing with the SafeDialer of the client.
+func buildTransport(wc *WrappedClient, config *Config) *http.Transport {
+	if config.BaseTransport == nil {
+		return &http.Transport{
+			TLSClientConfig:        wc.tlsConfig,
+			DialContext:            wc.dialer.DialContext,
+			DialTLSContext:         buildDialTLS(wc, config),
+			MaxResponseHeaderBytes: config.MaxResponseHeaderBytes,
+			// decompression is done by the client when the body is limited
+			DisableCompression: shouldDecompress(config),
+		}
+	}
+
+	transport := config.BaseTransport.Clone()
+
+	// BuildE rejects these, they are cleared in case the Config was built
+	// by hand
+	transport.Dial = nil
+	transport.DialTLS = nil
+	transport.Proxy = nil
+	transport.DialContext = wc.dialer.DialContext
+	transport.DialTLSContext = buildDialTLS(wc, config)
+
+	if wc.tlsConfig != nil {
+		transport.TLSClientConfig = wc.tlsConfig
+	}
+	if config.MaxResponseHeaderBytes != 0 {
+		transport.MaxResponseHeaderBytes = config.MaxResponseHeaderBytes
+	}
+	if shouldDecompress(config) {
+		transport.DisableCompression = true
+	}
+	return transport
+}
+
+// buildDialTLS returns a DialTLSContext running config.TLSHandshake on a
+// connection of the SafeDialer, or nil to let http.Transport do the
+// handshake.
+func buildDialTLS(wc *WrappedClient, config *Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if config.TLSHandshake == nil {
+		return nil
+	}
 
-		if !wc.config.IsIPv6Enabled && network == "tcp6" {
-			wc.log("ipv6 is disabled")
-			return &IPv6BlockedError{ip: address}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := wc.dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
 		}
 
-		host, port, _ := net.SplitHostPort(address)
+		tlsConn, err := config.TLSHandshake(ctx, conn, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
 
-		if !isPortAllowed(port, wc.config.AllowedPorts) {
-			wc.log(fmt.Sprintf("disallowed port: %v", port))
-			return &AllowedPortError{port: port}
+// buildRunFunc returns the control function of the dialer. The policy is read
+// from config on every call, so it follows SetConfig.
+func buildRunFunc(config func() *Config, logger *slog.Logger) func(ctx context.Context, network, address string, c syscall.RawConn) error {
+	return func(ctx context.Context, network, address string, _ syscall.RawConn) error {
+		logger.DebugContext(ctx, "connecting", slog.String("address", address))
+
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			err := &InvalidAddressError{violation{rule: RuleInvalidAddress, value: address, addr: address}}
+			logError(ctx, logger, "dialed address is not valid", err)
+			return err
 		}
 
 		ip := net.ParseIP(host)
 		if ip == nil {
-			panic(fmt.Sprintf("invalid ip: %v", host))
+			err := &InvalidAddressError{violation{rule: RuleInvalidAddress, value: host, addr: address}}
+			logError(ctx, logger, "dialed address is not an ip", err)
+			return err
 		}
 
-		if isIPAllowed(ip, wc.config.AllowedIPs, wc.config.AllowedIPsCIDR) {
-			return nil
+		_, err = checkAddress(ctx, network, ip, port, config(), logger)
+		if err != nil {
+			if state := getRequestState(ctx); state != nil {
+				setViolationHop(err, state.getHop())
+			}
 		}
+		return err
+	}
+}
 
-		// allowlist set in the config, but target IP was not found on the list
-		isConfigAllowListSet := wc.config.AllowedIPs != nil || wc.config.AllowedIPsCIDR != nil
-		if isConfigAllowListSet {
-			wc.log(fmt.Sprintf("ip: %v not found in allowlist", ip))
-			return &AllowedIPError{ip: ip.String()}
+// checkAddress applies the ipv6, port and ip policy to a resolved address.
+// It returns the rule that allowed or blocked the address.
+func checkAddress(ctx context.Context, network string, ip net.IP, port string, config *Config, logger *slog.Logger) (Rule, error) {
+	attrs := []slog.Attr{slog.String(LogKeyIP, ip.String()), slog.String(LogKeyPort, port)}
+
+	rule, err := evaluateAddress(network, ip, port, config, func(rule Rule, err error) bool {
+		return enforce(ctx, config, logger, "connection blocked", addressDecision(ip, port, rule), err, attrs...) != nil
+	})
+	if err == nil {
+		logAllowed(ctx, logger, "connection allowed", rule, attrs...)
+		emitDecision(ctx, config, addressDecision(ip, port, rule), DecisionAllow, nil)
+	}
+
+	return rule, err
+}
+
+// evaluateAddress checks an address against the policy. Every violation is
+// passed to enforced, which returns false to let the evaluation go on, e.g.
+// for rules in monitor mode.
+func evaluateAddress(network string, ip net.IP, port string, config *Config, enforced func(Rule, error) bool) (Rule, error) {
+	addr := net.JoinHostPort(ip.String(), port)
+
+	if !config.IsIPv6Enabled && (network == "tcp6" || network == "udp6") {
+		err := &IPv6BlockedError{violation{rule: RuleIPv6, value: ip.String(), addr: addr}}
+		if enforced(RuleIPv6, err) {
+			return RuleIPv6, err
 		}
+	}
 
-		if isIPBlocked(ip, wc.config.BlockedIPs, wc.config.BlockedIPsCIDR) {
-			wc.log(fmt.Sprintf("ip: %v found in blocklist", ip))
-			return &AllowedIPError{ip: ip.String()}
+	if rule, err := evaluatePort(port, addr, config, enforced); err != nil {
+		return rule, err
+	}
+
+	return evaluateIP(ip, addr, config, enforced)
+}
+
+func evaluatePort(port string, addr string, config *Config, enforced func(Rule, error) bool) (Rule, error) {
+	porti, err := strconv.Atoi(port)
+	if err != nil {
+		return RuleInvalidAddress, &InvalidAddressError{violation{rule: RuleInvalidAddress, value: port, addr: addr}}
+	}
+
+	if isPortBlocked(porti, config.BlockedPorts, config.BlockedPortRanges) {
+		err := &BlockedPortError{violation{rule: RuleBlockedPorts, value: port, addr: addr}}
+		if enforced(RuleBlockedPorts, err) {
+			return RuleBlockedPorts, err
+		}
+	}
+
+	if !isPortAllowed(porti, config.AllowedPorts, config.AllowedPortRanges) {
+		err := &AllowedPortError{violation{rule: RuleAllowedPorts, value: port, addr: addr}}
+		if enforced(RuleAllowedPorts, err) {
+			return RuleAllowedPorts, err
+		}
+	}
+
+	return RuleAllowedPorts, nil
+}
+
+func evaluateIP(ip net.IP, addr string, config *Config, enforced func(Rule, error) bool) (Rule, error) {
+	if isIPAllowed(ip, config.AllowedIPs, config.AllowedIPsCIDR) || config.isInAllowedPrefixes(ip) {
+		return RuleAllowedIPs, nil
+	}
+
+	if config.IsEmbeddedIPv4InspectionEnabled {
+		if embedded := embeddedIPv4(ip); embedded != nil {
+			return evaluateEmbeddedIPv4(ip, embedded, addr, config, enforced)
+		}
+	}
+
+	// allowlist set in the config, but target IP was not found on the list
+	isConfigAllowListSet := config.AllowedIPs != nil || config.AllowedIPsCIDR != nil || config.AllowedPrefixes != nil
+	if isConfigAllowListSet {
+		err := &AllowedIPError{violation{rule: RuleAllowedIPs, value: ip.String(), addr: addr}}
+		if enforced(RuleAllowedIPs, err) {
+			return RuleAllowedIPs, err
+		}
+	}
+
+	if isIPInList(ip, config.BlockedIPs, config.BlockedIPsCIDR) || config.isInBlockedPrefixes(ip) {
+		err := &BlockedIPError{violation{rule: RuleBlockedIPs, value: ip.String(), addr: addr}}
+		if enforced(RuleBlockedIPs, err) {
+			return RuleBlockedIPs, err
+		}
+	}
+
+	if isIPPrivate(ip) {
+		err := &BlockedIPError{violation{rule: RulePrivateNetworks, value: ip.String(), addr: addr}}
+		if enforced(RulePrivateNetworks, err) {
+			return RulePrivateNetworks, err
+		}
+	}
+
+	return RuleDefault, nil
+}
+
+// evaluateEmbeddedIPv4 applies the ip policy to the ipv4 addresses embedded
+// in ip. The ipv6 address itself is only checked against the blocklist, as
+// the private networks cover the transition prefixes wholesale.
+func evaluateEmbeddedIPv4(ip net.IP, embedded []net.IP, addr string, config *Config, enforced func(Rule, error) bool) (Rule, error) {
+	if isIPInList(ip, config.BlockedIPs, config.BlockedIPsCIDR) || config.isInBlockedPrefixes(ip) {
+		err := &BlockedIPError{violation{rule: RuleBlockedIPs, value: ip.String(), addr: addr}}
+		if enforced(RuleBlockedIPs, err) {
+			return RuleBlockedIPs, err
+		}
+	}
+
+	rule := RuleDefault
+	for _, ipv4 := range embedded {
+		var err error
+		rule, err = evaluateIP(ipv4, addr, config, enforced)
+		if err != nil {
+			return rule, err
+		}
+	}
+	return rule, nil
+}
+
+func buildCheckRedirectFunc(wc *WrappedClient) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		hop := len(via)
+		wc.logger.DebugContext(req.Context(), "following redirect", slog.Int("hop", hop), slog.String(LogKeyURL, req.URL.Redacted()))
+
+		if state := getRequestState(req.Context()); state != nil {
+			state.setHop(hop)
+			state.setURL(req.URL.Redacted())
+		}
+
+		// every hop must satisfy the same url policy as the initial request,
+		// the dial-time checks alone do not cover hosts, schemes and credentials
+		config := wc.Config()
+		err := validateURL(req.Context(), req.URL, config, wc.logger)
+		if err != nil {
+			setViolationHop(err, hop)
+			return &RedirectError{hop: hop, url: req.URL.Redacted(), err: err}
+		}
+
+		if config.CheckRedirect != nil {
+			return config.CheckRedirect(req, via)
+		}
+
+		// mirror the default policy of http.Client
+		if hop >= maxRedirects {
+			return fmt.Errorf("stopped after %v redirects", maxRedirects)
 		}
 
 		return nil
@@ -73,7 +268,40 @@ func buildRunFunc(wc *WrappedClient) func(network, address string, c syscall.Raw
 
 /* validators */
 
-func validateCredentials(parsed *urllib.URL, config *Config, debugLogFunc func(string)) error {
+func validateURL(ctx context.Context, parsed *urllib.URL, config *Config, logger *slog.Logger) error {
+	err := validateCredentials(ctx, parsed, config, logger)
+	if err != nil {
+		return err
+	}
+
+	err = isSchemeValid(ctx, parsed, config, logger)
+	if err != nil {
+		return err
+	}
+
+	err = isHostValid(ctx, parsed, config, logger)
+	if err != nil {
+		return err
+	}
+
+	err = isSchemePortValid(ctx, parsed, config, logger)
+	if err != nil {
+		return err
+	}
+
+	logAllowed(ctx, logger, "url allowed", "", urlAttrs(parsed)...)
+	emitDecision(ctx, config, urlDecision(parsed, ""), DecisionAllow, nil)
+	return nil
+}
+
+func urlAttrs(parsed *urllib.URL) []slog.Attr {
+	return []slog.Attr{
+		slog.String(LogKeyURL, parsed.Redacted()),
+		slog.String(LogKeyHost, parsed.Hostname()),
+	}
+}
+
+func validateCredentials(ctx context.Context, parsed *urllib.URL, config *Config, logger *slog.Logger) error {
 	if config.AllowSendingCredentials {
 		return nil
 	}
@@ -83,45 +311,131 @@ func validateCredentials(parsed *urllib.URL, config *Config, debugLogFunc func(s
 	password = strings.TrimSpace(password)
 
 	if username != "" || password != "" {
-		debugLogFunc("credentials found in supplied url.")
-		return &SendingCredentialsBlockedError{}
+		err := &SendingCredentialsBlockedError{violation{rule: RuleCredentials}}
+		return enforce(ctx, config, logger, "credentials found in supplied url", urlDecision(parsed, RuleCredentials), err, urlAttrs(parsed)...)
 	}
 
 	return nil
 }
 
-func isSchemeValid(parsed *urllib.URL, config *Config, debugLogFunc func(string)) error {
+func isSchemeValid(ctx context.Context, parsed *urllib.URL, config *Config, logger *slog.Logger) error {
 	scheme := parsed.Scheme
 	if len(scheme) > 0 && !isSchemeAllowed(scheme, config.AllowedSchemes) {
-		debugLogFunc(fmt.Sprintf("disallowed scheme: %v", scheme))
-		return &AllowedSchemeError{scheme: scheme}
+		err := &AllowedSchemeError{violation{rule: RuleAllowedSchemes, value: scheme}}
+		return enforce(ctx, config, logger, "disallowed scheme", urlDecision(parsed, RuleAllowedSchemes), err, urlAttrs(parsed)...)
 	}
 	return nil
 }
 
-func isHostValid(parsed *urllib.URL, config *Config, debugLogFunc func(string)) error {
+func isSchemePortValid(ctx context.Context, parsed *urllib.URL, config *Config, logger *slog.Logger) error {
+	scheme := strings.ToLower(parsed.Scheme)
+	allowedPorts, ok := config.AllowedSchemePorts[scheme]
+	if !ok {
+		return nil
+	}
+
+	port := parsed.Port()
+	if port == "" {
+		defaultPort, ok := config.SchemeDefaultPorts[scheme]
+		if !ok {
+			err := &AllowedSchemePortError{violation: violation{rule: RuleAllowedSchemePorts}, scheme: scheme}
+			return enforce(ctx, config, logger, "no default port for scheme", urlDecision(parsed, RuleAllowedSchemePorts), err, urlAttrs(parsed)...)
+		}
+		port = strconv.Itoa(defaultPort)
+	}
+
+	porti, err := strconv.Atoi(port)
+	if err != nil || !isPortInRanges(porti, allowedPorts) {
+		err := &AllowedSchemePortError{violation: violation{rule: RuleAllowedSchemePorts, value: port}, scheme: scheme}
+		attrs := append(urlAttrs(parsed), slog.String(LogKeyPort, port))
+		return enforce(ctx, config, logger, "disallowed port for scheme", urlDecision(parsed, RuleAllowedSchemePorts), err, attrs...)
+	}
+
+	return nil
+}
+
+func isHostValid(ctx context.Context, parsed *urllib.URL, config *Config, logger *slog.Logger) error {
 	host := parsed.Hostname()
 	if host == "" {
-		debugLogFunc("empty host received")
-		return &InvalidHostError{host: ""}
+		err := &InvalidHostError{violation{rule: RuleInvalidHost, value: ""}}
+		return enforce(ctx, config, logger, "empty host received", urlDecision(parsed, RuleInvalidHost), err, urlAttrs(parsed)...)
+	}
+
+	// blocked hosts take precedence, so a wildcard allowlist entry can be
+	// narrowed down by blocking specific names under it
+	if isBlockedHost(host, config.BlockedHosts) {
+		err := enforce(ctx, config, logger, "blocked host", urlDecision(parsed, RuleBlockedHosts),
+			&BlockedHostError{violation{rule: RuleBlockedHosts, value: host}}, urlAttrs(parsed)...)
+		if err != nil {
+			return err
+		}
 	}
 
 	if config.AllowedHosts != nil && !isAllowedHost(host, config.AllowedHosts) {
-		debugLogFunc(fmt.Sprintf("disallowed host: %s", host))
-		return &AllowedHostError{host: host}
+		err := &AllowedHostError{violation{rule: RuleAllowedHosts, value: host}}
+		return enforce(ctx, config, logger, "disallowed host", urlDecision(parsed, RuleAllowedHosts), err, urlAttrs(parsed)...)
 	}
 
 	return nil
 }
 
+/* request state */
+
+type requestStateKey struct{}
+
+// requestState follows a request through its redirects, so errors raised
+// while dialing can report the hop they occurred on.
+type requestState struct {
+	hop atomic.Int64
+	// redacted url of the current hop
+	url atomic.Value
+
+	// set when the client added Accept-Encoding and has to decompress the
+	// response itself
+	requestedGzip bool
+}
+
+func withRequestState(ctx context.Context) context.Context {
+	if getRequestState(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestStateKey{}, &requestState{})
+}
+
+func getRequestState(ctx context.Context) *requestState {
+	state, _ := ctx.Value(requestStateKey{}).(*requestState)
+	return state
+}
+
+func (s *requestState) getHop() int {
+	return int(s.hop.Load())
+}
+
+func (s *requestState) setHop(hop int) {
+	s.hop.Store(int64(hop))
+}
+
+func (s *requestState) getURL() string {
+	url, _ := s.url.Load().(string)
+	return url
+}
+
+func (s *requestState) setURL(url string) {
+	s.url.Store(url)
+}
+
 /* wrapper */
 
+// same limit as the default redirect policy of http.Client
+const maxRedirects = 10
+
 type WrappedClient struct {
 	Client *http.Client
 
-	config    *Config
 	tlsConfig *tls.Config
-	resolver  *net.Resolver
+	resolver  Resolver
+	dialer    *SafeDialer
+	logger    *slog.Logger
 
 	// used for track DNS resolutions for testing purposes
 	tracer *tracer
@@ -129,32 +443,66 @@ type WrappedClient struct {
 
 func Client(config *Config) *WrappedClient {
 	tlsConfig := config.TlsConfig
-
-	var resolver *net.Resolver = nil
-	if config.InTestMode {
-		resolver = &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{}
-				return d.DialContext(ctx, "udp", "localhost:8053")
-			},
-		}
-	}
+	dialer := Dialer(config)
 
 	wc := &WrappedClient{
-		config:    config,
 		tlsConfig: tlsConfig,
-		resolver:  resolver,
+		resolver:  dialer.resolver,
+		dialer:    dialer,
+		logger:    dialer.logger,
 	}
 
-	wc.Client = buildHttpClient(wc)
+	wc.Client = buildHttpClient(wc, config)
 	return wc
 }
 
+// Config returns the policy currently enforced by the client.
+func (wc *WrappedClient) Config() *Config {
+	return wc.dialer.Config()
+}
+
+// SetConfig replaces the policy of the client while it is in use. Requests
+// and dials started afterwards are checked against config, and connections
+// to addresses it no longer allows are closed, whether idle or in use.
+//
+// The http.Client isn't rebuilt, so Timeout, Jar, TlsConfig,
+// MaxResponseHeaderBytes, BaseTransport, TLSHandshake, Logger and Resolver
+// keep their original values.
+func (wc *WrappedClient) SetConfig(config *Config) {
+	wc.dialer.SetConfig(config)
+}
+
+// NewRequest wraps http.NewRequest and additionally rejects urls that
+// don't pass the scheme, host and credentials checks of the client.
+func (wc *WrappedClient) NewRequest(method, url string, body io.Reader) (*http.Request, error) {
+	return wc.NewRequestWithContext(context.Background(), method, url, body)
+}
+
+// NewRequestWithContext wraps http.NewRequestWithContext and additionally
+// rejects urls that don't pass the scheme, host and credentials checks of
+// the client.
+func (wc *WrappedClient) NewRequestWithContext(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateURL(ctx, req.URL, wc.Config(), wc.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
 func (wc *WrappedClient) Head(url string) (resp *http.Response, err error) {
-	wc.log("calling proxied Head...")
+	return wc.HeadContext(context.Background(), url)
+}
+
+func (wc *WrappedClient) HeadContext(ctx context.Context, url string) (resp *http.Response, err error) {
+	wc.logger.DebugContext(ctx, "calling proxied Head")
 
-	req, err := http.NewRequest("HEAD", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -163,9 +511,13 @@ func (wc *WrappedClient) Head(url string) (resp *http.Response, err error) {
 }
 
 func (wc *WrappedClient) Get(url string) (resp *http.Response, err error) {
-	wc.log("calling proxied Get...")
+	return wc.GetContext(context.Background(), url)
+}
+
+func (wc *WrappedClient) GetContext(ctx context.Context, url string) (resp *http.Response, err error) {
+	wc.logger.DebugContext(ctx, "calling proxied Get")
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -174,13 +526,18 @@ func (wc *WrappedClient) Get(url string) (resp *http.Response, err error) {
 }
 
 func (wc *WrappedClient) Post(url string, contentType string, body io.Reader) (resp *http.Response, err error) {
-	wc.log("calling proxied Post...")
+	return wc.PostContext(context.Background(), url, contentType, body)
+}
 
-	req, err := http.NewRequest("POST", url, body)
+func (wc *WrappedClient) PostContext(ctx context.Context, url string, contentType string, body io.Reader) (resp *http.Response, err error) {
+	wc.logger.DebugContext(ctx, "calling proxied Post")
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return nil, err
 	}
 
+	req.Header.Set("Content-Type", contentType)
 	return wc.Do(req)
 }
 
@@ -189,9 +546,18 @@ func (wc *WrappedClient) PostForm(url string, data urllib.Values) (resp *http.Re
 }
 
 func (wc *WrappedClient) Do(req *http.Request) (resp *http.Response, err error) {
-	wc.log("calling proxied Do...")
+	wc.logger.DebugContext(req.Context(), "calling proxied Do")
+
+	req = req.WithContext(withRequestState(req.Context()))
+
+	config := wc.Config()
+	if config.Metrics != nil {
+		defer func() {
+			recordRequest(config.Metrics, config, err)
+		}()
+	}
 
-	if wc.config.InTestMode {
+	if config.InTestMode {
 		wc.tracer = &tracer{}
 		req = req.WithContext(httptrace.WithClientTrace(req.Context(), wc.tracer.buildTracer()))
 	}
@@ -204,28 +570,33 @@ func (wc *WrappedClient) Do(req *http.Request) (resp *http.Response, err error)
 		return nil, err
 	}
 
-	err = validateCredentials(parsedURL, wc.config, wc.log)
-	if err != nil {
-		return nil, err
-	}
+	getRequestState(req.Context()).setURL(parsedURL.Redacted())
 
-	err = isSchemeValid(parsedURL, wc.config, wc.log)
+	err = validateURL(req.Context(), parsedURL, config, wc.logger)
 	if err != nil {
 		return nil, err
 	}
 
-	err = isHostValid(parsedURL, wc.config, wc.log)
+	req = prepareLimitedRequest(req, config)
+
+	resp, err = wc.Client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, wrapHeaderLimitError(err, config)
 	}
 
-	return wc.Client.Do(req)
+	return limitResponse(resp, config)
 }
 
 func (wc *WrappedClient) CloseIdleConnections() {
 	wc.Client.CloseIdleConnections()
 }
 
+// Dialer returns the dialer the client connects with, for connections that
+// must follow the same policy outside of HTTP.
+func (wc *WrappedClient) Dialer() *SafeDialer {
+	return wc.dialer
+}
+
 /* testing */
 
 type tracer struct {
@@ -239,77 +610,3 @@ func (t *tracer) buildTracer() *httptrace.ClientTrace {
 		},
 	}
 }
-
-/* error */
-
-type AllowedPortError struct {
-	port string
-}
-
-func (e *AllowedPortError) Error() string {
-	return fmt.Sprintf("port: %v not found in allowlist", e.port)
-}
-
-type AllowedSchemeError struct {
-	scheme string
-}
-
-func (e *AllowedSchemeError) Error() string {
-	return fmt.Sprintf("scheme: %v not found in allowlist", e.scheme)
-}
-
-type InvalidHostError struct {
-	host string
-}
-
-func (e *InvalidHostError) Error() string {
-	return fmt.Sprintf("host: %v is not valid", e.host)
-}
-
-type AllowedHostError struct {
-	host string
-}
-
-func (e *AllowedHostError) Error() string {
-	return fmt.Sprintf("host: %v not found in allowlist", e.host)
-}
-
-type AllowedIPError struct {
-	ip string
-}
-
-func (e *AllowedIPError) Error() string {
-	return fmt.Sprintf("ip: %v not found in allowlist", e.ip)
-}
-
-type IPv6BlockedError struct {
-	ip string
-}
-
-func (e *IPv6BlockedError) Error() string {
-	return fmt.Sprintf("ipv6 blocked. connection to %v dropped", e.ip)
-}
-
-type SendingCredentialsBlockedError struct {
-}
-
-func (e *SendingCredentialsBlockedError) Error() string {
-	return fmt.Sprintf("sending credentials blocked.")
-}
-
-func unwrap(err error) error {
-	wrapped, ok := err.(interface{ Unwrap() error })
-	if !ok {
-		return err
-	}
-	inner := wrapped.Unwrap()
-	return unwrap(inner)
-}
-
-/* debug */
-
-func (wc *WrappedClient) log(msg string) {
-	if wc.config.IsDebugLoggingEnabled {
-		fmt.Printf("[safeurl] %v\n", msg)
-	}
-}
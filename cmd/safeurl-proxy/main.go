@@ -0,0 +1,196 @@
+// Command safeurl-proxy runs an HTTP forward proxy enforcing a safeurl
+// policy on every request and CONNECT tunnel.
+//
+//	safeurl-proxy -policy policy.yaml -listen :3128
+//	safeurl-proxy -policy policy.yaml -listen :3128 -listen 127.0.0.1:3129=internal.yaml
+//	safeurl-proxy -policy policy.yaml -listen :3128 -users users.yaml
+//
+// A listener can have its own policy file after "=". The users file maps
+// usernames to their password and, optionally, their policy file:
+//
+//	alice:
+//	  password: secret
+//	  policy: alice.yaml
+//
+// The SAFEURL_* environment variables override every policy file.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/doyensec/safeurl"
+	"github.com/doyensec/safeurl/proxy"
+	"gopkg.in/yaml.v3"
+)
+
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+type userEntry struct {
+	Password string `yaml:"password"`
+	Policy   string `yaml:"policy"`
+}
+
+func main() {
+	var listens listFlag
+	policyPath := flag.String("policy", "", "policy file used by listeners and users without one, the default policy if empty")
+	usersPath := flag.String("users", "", "file of the users allowed to use the proxy, no authentication if empty")
+	flag.Var(&listens, "listen", "address to listen on, optionally followed by =policy file, can be repeated")
+	flag.Parse()
+
+	if len(listens) == 0 {
+		listens = listFlag{":3128"}
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	err := run(logger, *policyPath, *usersPath, listens)
+	if err != nil {
+		logger.Error("safeurl-proxy failed", slog.Any("error", err))
+		os.Exit(1)
+	}
+}
+
+func run(logger *slog.Logger, policyPath, usersPath string, listens []string) error {
+	loader := &configLoader{logger: logger, configs: make(map[string]*safeurl.Config)}
+
+	defaultConfig, err := loader.load(policyPath)
+	if err != nil {
+		return err
+	}
+
+	server := proxy.New(defaultConfig)
+	if usersPath != "" {
+		server.Users, err = loader.loadUsers(usersPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, len(listens))
+	var servers []*http.Server
+	for _, listen := range listens {
+		addr, path, ok := strings.Cut(listen, "=")
+
+		config := defaultConfig
+		if !ok {
+			path = policyPath
+		} else {
+			config, err = loader.load(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		srv := &http.Server{
+			Addr:              addr,
+			Handler:           server.Handler(config),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		servers = append(servers, srv)
+
+		go func() {
+			logger.Info("listening", slog.String("address", addr), slog.String("policy", path))
+			errs <- srv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(shutdownCtx)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// configLoader builds a Config per policy file, so listeners and users
+// sharing a file share its clients.
+type configLoader struct {
+	logger  *slog.Logger
+	configs map[string]*safeurl.Config
+}
+
+func (l *configLoader) load(path string) (*safeurl.Config, error) {
+	if config, ok := l.configs[path]; ok {
+		return config, nil
+	}
+
+	policy := &safeurl.Policy{Version: safeurl.PolicyVersion}
+	if path != "" {
+		var err error
+		policy, err = safeurl.LoadPolicyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+	}
+
+	err := policy.ApplyEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := policy.ConfigBuilder().
+		SetLogger(l.logger.With(slog.String("policy", path))).
+		BuildE()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	l.configs[path] = config
+	return config, nil
+}
+
+func (l *configLoader) loadUsers(path string) (map[string]proxy.User, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries map[string]userEntry
+	err = yaml.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	users := make(map[string]proxy.User, len(entries))
+	for name, entry := range entries {
+		user := proxy.User{Password: entry.Password}
+		if entry.Policy != "" {
+			user.Config, err = l.load(entry.Policy)
+			if err != nil {
+				return nil, err
+			}
+		}
+		users[name] = user
+	}
+	return users, nil
+}
@@ -0,0 +1,120 @@
+package safeurl
+
+import (
+	"context"
+	"net"
+	urllib "net/url"
+	"slices"
+	"strconv"
+)
+
+// values of Decision.Stage
+const (
+	// the url was checked against the scheme, host, port and credentials
+	// policy, before the request or on a redirect
+	StageURL = "url"
+	// a resolved address was checked against the ip, port and ipv6 policy
+	StageAddress = "address"
+)
+
+// Decision describes a single allow or deny verdict. It is passed to
+// Config.OnDecision together with the context of the request.
+type Decision struct {
+	Stage string
+	// redacted url of the request, or of the redirect being followed
+	URL string
+	// 0 for the initial request, n for the n-th redirect
+	Hop int
+
+	// resolved address, only set at the address stage
+	IP net.IP
+	// port of the address, or of the url if it has one
+	Port string
+
+	Rule Rule
+	// name of the Config field the rule matched, e.g. BlockedIPsCIDR, empty
+	// for rules that aren't backed by a list
+	List string
+
+	// DecisionAllow, DecisionDeny or DecisionMonitor
+	Outcome string
+	// the violation, nil when the target was allowed
+	Err error
+}
+
+func urlDecision(parsed *urllib.URL, rule Rule) Decision {
+	return Decision{Stage: StageURL, URL: parsed.Redacted(), Port: parsed.Port(), Rule: rule}
+}
+
+func addressDecision(ip net.IP, port string, rule Rule) Decision {
+	return Decision{Stage: StageAddress, IP: ip, Port: port, Rule: rule}
+}
+
+// emitDecision completes decision with the state of the request and passes it
+// to OnDecision.
+func emitDecision(ctx context.Context, config *Config, decision Decision, outcome string, err error) {
+	if config.OnDecision == nil {
+		return
+	}
+
+	decision.Outcome = outcome
+	decision.Err = err
+	decision.List = matchedList(decision, config)
+
+	if state := getRequestState(ctx); state != nil {
+		decision.Hop = state.getHop()
+		if decision.URL == "" {
+			decision.URL = state.getURL()
+		}
+	}
+
+	config.OnDecision(ctx, decision)
+}
+
+// matchedList returns the name of the Config field behind the rule of
+// decision.
+func matchedList(decision Decision, config *Config) string {
+	switch decision.Rule {
+	case RuleAllowedSchemes:
+		return "AllowedSchemes"
+	case RuleAllowedHosts:
+		return "AllowedHosts"
+	case RuleBlockedHosts:
+		return "BlockedHosts"
+	case RuleAllowedSchemePorts:
+		return "AllowedSchemePorts"
+	case RuleAllowedPorts:
+		return "AllowedPorts"
+	case RuleBlockedPorts:
+		port, _ := strconv.Atoi(decision.Port)
+		if slices.Contains(config.BlockedPorts, port) {
+			return "BlockedPorts"
+		}
+		return "BlockedPortRanges"
+	case RuleAllowedIPs:
+		if decision.Err != nil {
+			return "AllowedIPs"
+		}
+		return matchedIPList(decision.IP, config.AllowedIPs, config.AllowedIPsCIDR, config.isInAllowedPrefixes,
+			"AllowedIPs", "AllowedIPsCIDR", "AllowedPrefixes")
+	case RuleBlockedIPs:
+		return matchedIPList(decision.IP, config.BlockedIPs, config.BlockedIPsCIDR, config.isInBlockedPrefixes,
+			"BlockedIPs", "BlockedIPsCIDR", "BlockedPrefixes")
+	}
+	return ""
+}
+
+func matchedIPList(ip net.IP, ips []net.IP, ipsCIDR []net.IPNet, inPrefixes func(net.IP) bool, ipsName, cidrName, prefixesName string) string {
+	// the rule may have matched the ipv4 address embedded in ip
+	for _, candidate := range append([]net.IP{ip}, embeddedIPv4(ip)...) {
+		switch {
+		case isIPInList(candidate, ips, nil):
+			return ipsName
+		case isIPInList(candidate, nil, ipsCIDR):
+			return cidrName
+		case inPrefixes(candidate):
+			return prefixesName
+		}
+	}
+	return ""
+}
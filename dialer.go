@@ -0,0 +1,332 @@
+package safeurl
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SafeDialer enforces the ip, port and ipv6 policy of a Config on every
+// connection it makes. The checks run at the syscall.RawConn control stage,
+// after DNS resolution, so the address being validated is the address being
+// connected to.
+//
+// It can be used wherever a dial function is accepted, e.g. smtp, database
+// drivers or grpc.WithContextDialer.
+type SafeDialer struct {
+	config   atomic.Pointer[Config]
+	resolver Resolver
+	dialer   *net.Dialer
+	logger   *slog.Logger
+
+	// live connections, checked again when the config is replaced
+	connsMu sync.Mutex
+	conns   map[*trackedConn]struct{}
+}
+
+func Dialer(config *Config) *SafeDialer {
+	d := &SafeDialer{
+		resolver: buildResolver(config),
+		logger:   buildLogger(config),
+		conns:    make(map[*trackedConn]struct{}),
+	}
+	d.config.Store(config)
+
+	// the dialer only ever receives ip addresses, resolution is done by
+	// DialContext so the answers of the configured Resolver are the ones
+	// checked by the control function
+	d.dialer = &net.Dialer{
+		ControlContext: buildRunFunc(d.Config, d.logger),
+	}
+
+	return d
+}
+
+// Config returns the policy currently enforced by the dialer.
+func (d *SafeDialer) Config() *Config {
+	return d.config.Load()
+}
+
+// SetConfig replaces the policy of the dialer. Dials started afterwards are
+// checked against config and live connections to addresses it doesn't allow
+// are closed. The resolver and logger keep their original values.
+func (d *SafeDialer) SetConfig(config *Config) {
+	d.config.Store(config)
+
+	d.connsMu.Lock()
+	var forbidden []*trackedConn
+	for conn := range d.conns {
+		rule, err := conn.evaluate(config)
+		if err != nil {
+			logBlocked(context.Background(), d.logger, "closing connection forbidden by the new config", rule, err, conn.attrs()...)
+			forbidden = append(forbidden, conn)
+		}
+	}
+	d.connsMu.Unlock()
+
+	for _, conn := range forbidden {
+		conn.Close()
+	}
+}
+
+func (d *SafeDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *SafeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		err := &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+		logBlocked(ctx, d.logger, "unsupported network", RuleNetwork, err, slog.String("address", address))
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	config := d.Config()
+
+	if config.Proxy != nil {
+		if !strings.HasPrefix(network, "tcp") {
+			err := &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+			logBlocked(ctx, d.logger, "network not supported through the proxy", RuleNetwork, err, slog.String("address", address))
+			return nil, err
+		}
+		if config.IsProxyResolutionEnabled && net.ParseIP(host) == nil {
+			return d.dialProxyResolved(ctx, config, network, host, port)
+		}
+	}
+
+	ips, err := d.resolve(ctx, host, config)
+	if err != nil {
+		logError(ctx, d.logger, "failed to resolve host", err, slog.String(LogKeyHost, host))
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	cache, _ := d.resolver.(*DNSCache)
+
+	// try the addresses in order like net.Dialer does and return the first
+	// error if none of them can be connected to
+	var firstErr error
+	for _, ip := range ips {
+		if !matchesNetwork(network, ip) {
+			continue
+		}
+
+		var conn net.Conn
+		err := d.checkCachedVerdict(ctx, cache, config, host, network, ip, port)
+		if err == nil {
+			start := time.Now()
+			conn, err = d.dialIP(ctx, config, network, ip, port)
+			if config.Metrics != nil {
+				config.Metrics.ObserveDial(time.Since(start), err)
+			}
+		}
+
+		if cache != nil {
+			var violation PolicyViolation
+			if err == nil {
+				cache.storeVerdict(host, ip, config, true)
+			} else if errors.As(err, &violation) {
+				cache.storeVerdict(host, ip, config, false)
+			}
+		}
+
+		if err == nil {
+			conn, err = d.track(ctx, &trackedConn{Conn: conn, network: ipNetwork(network, ip), ip: ip, port: port}, config)
+			if err == nil {
+				return conn, nil
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "no suitable address found", Addr: host}}
+	}
+
+	return nil, firstErr
+}
+
+// resolve looks up host, timing the lookup if metrics are enabled. IP
+// literals aren't resolved and aren't measured.
+func (d *SafeDialer) resolve(ctx context.Context, host string, config *Config) ([]net.IP, error) {
+	if config.Metrics == nil || net.ParseIP(host) != nil {
+		return resolveHost(ctx, host, d.resolver)
+	}
+
+	start := time.Now()
+	ips, err := resolveHost(ctx, host, d.resolver)
+	config.Metrics.ObserveResolution(time.Since(start), err)
+	return ips, err
+}
+
+// dialIP connects to ip directly, or through the proxy after checking it
+// against the policy, as the control function only sees the proxy then.
+func (d *SafeDialer) dialIP(ctx context.Context, config *Config, network string, ip net.IP, port string) (net.Conn, error) {
+	address := net.JoinHostPort(ip.String(), port)
+	if config.Proxy == nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+
+	if err := d.checkTarget(ctx, config, ipNetwork(network, ip), ip, port); err != nil {
+		return nil, err
+	}
+	return dialProxy(ctx, config.Proxy, network, address)
+}
+
+// checkCachedVerdict fails without opening a socket if the cache remembers
+// ip as denied. The policy is evaluated again, so the error, logs and hop are
+// specific to this request.
+func (d *SafeDialer) checkCachedVerdict(ctx context.Context, cache *DNSCache, config *Config, host, network string, ip net.IP, port string) error {
+	if cache == nil || !cache.isDenied(host, ip, config) {
+		return nil
+	}
+	return d.checkTarget(ctx, config, ipNetwork(network, ip), ip, port)
+}
+
+// checkTarget applies the policy to an address outside of the control
+// function and returns the error the control function would.
+func (d *SafeDialer) checkTarget(ctx context.Context, config *Config, network string, ip net.IP, port string) error {
+	_, err := checkAddress(ctx, network, ip, port, config, d.logger)
+	if err == nil {
+		return nil
+	}
+
+	if state := getRequestState(ctx); state != nil {
+		setViolationHop(err, state.getHop())
+	}
+	return &net.OpError{Op: "dial", Net: network, Addr: &net.TCPAddr{IP: ip}, Err: err}
+}
+
+// ipNetwork returns the ip version specific form of network, e.g. tcp6 for
+// tcp and an ipv6 address, as passed to the control function.
+func ipNetwork(network string, ip net.IP) string {
+	network = strings.TrimRight(network, "46")
+	if ip.To4() != nil {
+		return network + "4"
+	}
+	return network + "6"
+}
+
+func matchesNetwork(network string, ip net.IP) bool {
+	switch network {
+	case "tcp4", "udp4":
+		return ip.To4() != nil
+	case "tcp6", "udp6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// DialTimeout behaves like DialContext with a context that expires after
+// timeout. It matches the signature expected by e.g. redis clients.
+func (d *SafeDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return d.DialContext(ctx, network, address)
+}
+
+// trackedConn removes itself from the live connections of its dialer when
+// closed.
+type trackedConn struct {
+	net.Conn
+	dialer  *SafeDialer
+	network string
+	ip      net.IP
+	// set instead of ip for connections resolved by the proxy
+	host string
+	port string
+}
+
+// track adds conn, dialed under config, to the live connections of the
+// dialer. SetConfig may have replaced config and closed the forbidden
+// connections while conn was being dialed, so conn is checked against the
+// current config once it is tracked.
+func (d *SafeDialer) track(ctx context.Context, tracked *trackedConn, config *Config) (net.Conn, error) {
+	tracked.dialer = d
+
+	d.connsMu.Lock()
+	d.conns[tracked] = struct{}{}
+	d.connsMu.Unlock()
+
+	current := d.Config()
+	if current == config {
+		return tracked, nil
+	}
+
+	rule, err := tracked.evaluate(current)
+	if err != nil {
+		logBlocked(ctx, d.logger, "closing connection forbidden by the new config", rule, err, tracked.attrs()...)
+		tracked.Close()
+
+		opErr := &net.OpError{Op: "dial", Net: tracked.network, Err: err}
+		if tracked.ip != nil {
+			opErr.Addr = &net.TCPAddr{IP: tracked.ip}
+		}
+		return nil, opErr
+	}
+	return tracked, nil
+}
+
+// evaluate checks the connection against config, ignoring the rules in
+// monitor mode. Only the port of connections resolved by the proxy can be
+// checked.
+func (c *trackedConn) evaluate(config *Config) (Rule, error) {
+	enforced := func(rule Rule, _ error) bool {
+		return !config.isMonitored(rule)
+	}
+
+	if c.ip == nil {
+		return evaluatePort(c.port, net.JoinHostPort(c.host, c.port), config, enforced)
+	}
+	return evaluateAddress(c.network, c.ip, c.port, config, enforced)
+}
+
+func (c *trackedConn) attrs() []slog.Attr {
+	if c.ip == nil {
+		return []slog.Attr{slog.String(LogKeyHost, c.host), slog.String(LogKeyPort, c.port)}
+	}
+	return []slog.Attr{slog.String(LogKeyIP, c.ip.String()), slog.String(LogKeyPort, c.port)}
+}
+
+func (c *trackedConn) Close() error {
+	c.dialer.connsMu.Lock()
+	delete(c.dialer.conns, c)
+	c.dialer.connsMu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the connection, so tunnels can
+// forward a half-close. It fails with errors.ErrUnsupported when the
+// underlying connection can't be half-closed.
+func (c *trackedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// Unwrap returns the underlying connection.
+func (c *trackedConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,175 @@
+package safeurl
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	urllib "net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var defaultProxyPorts = map[string]string{
+	"http":   "80",
+	"https":  "443",
+	"socks5": "1080",
+}
+
+// parseProxy checks the scheme of a proxy url and adds the default port of
+// the scheme if it's missing.
+func parseProxy(rawURL string) (*urllib.URL, error) {
+	parsed, err := urllib.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultPort, ok := defaultProxyPorts[parsed.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported proxy scheme: %v", parsed.Scheme)
+	}
+	if parsed.Hostname() == "" {
+		return nil, fmt.Errorf("proxy url has no host: %v", parsed.Redacted())
+	}
+	if parsed.Port() == "" {
+		parsed.Host = net.JoinHostPort(parsed.Hostname(), defaultPort)
+	}
+	return parsed, nil
+}
+
+// dialProxyResolved connects to host through the proxy without resolving it,
+// leaving the resolution to the proxy. Only the port policy can be checked.
+func (d *SafeDialer) dialProxyResolved(ctx context.Context, config *Config, network, host, port string) (net.Conn, error) {
+	attrs := []slog.Attr{slog.String(LogKeyHost, host), slog.String(LogKeyPort, port)}
+
+	rule, err := evaluatePort(port, net.JoinHostPort(host, port), config, func(rule Rule, err error) bool {
+		return enforce(ctx, config, d.logger, "connection blocked", addressDecision(nil, port, rule), err, attrs...) != nil
+	})
+	if err != nil {
+		if state := getRequestState(ctx); state != nil {
+			setViolationHop(err, state.getHop())
+		}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	logAllowed(ctx, d.logger, "connection allowed, resolved by the proxy", rule, attrs...)
+	emitDecision(ctx, config, addressDecision(nil, port, rule), DecisionAllow, nil)
+
+	start := time.Now()
+	conn, err := dialProxy(ctx, config.Proxy, network, net.JoinHostPort(host, port))
+	if config.Metrics != nil {
+		config.Metrics.ObserveDial(time.Since(start), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.track(ctx, &trackedConn{Conn: conn, network: network, host: host, port: port}, config)
+}
+
+// dialProxy opens a tunnel to address through the proxy. The proxy is
+// trusted, the connection to it isn't checked against the policy.
+func dialProxy(ctx context.Context, proxyURL *urllib.URL, network, address string) (net.Conn, error) {
+	forward := &net.Dialer{}
+
+	var conn net.Conn
+	var err error
+	switch proxyURL.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+
+		var dialer proxy.Dialer
+		dialer, err = proxy.SOCKS5("tcp", proxyURL.Host, auth, forward)
+		if err == nil {
+			conn, err = dialer.(proxy.ContextDialer).DialContext(ctx, network, address)
+		}
+	default:
+		conn, err = dialConnect(ctx, forward, proxyURL, address)
+	}
+
+	if err != nil {
+		return nil, &net.OpError{Op: "proxyconnect", Net: network, Err: err}
+	}
+	return conn, nil
+}
+
+// dialConnect opens a tunnel with an HTTP CONNECT request.
+func dialConnect(ctx context.Context, forward *net.Dialer, proxyURL *urllib.URL, address string) (net.Conn, error) {
+	conn, err := forward.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// unblock the exchange below when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &urllib.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	br := bufio.NewReader(conn)
+	err = req.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(br, req)
+	}
+
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused to connect to %v: %v", address, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns the bytes the proxy sent right after its response
+// before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
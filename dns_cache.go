@@ -0,0 +1,242 @@
+package safeurl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// size an unbounded cache grows to before its expired entries are swept
+const dnsCacheSweepSize = 64
+
+type DNSCacheOptions struct {
+	// ttl of answers from resolvers that don't implement TTLResolver
+	DefaultTTL time.Duration
+	// bounds applied to the ttls reported by the resolver
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// how long a host that doesn't exist is cached for, 0 disables
+	// negative caching
+	NegativeTTL time.Duration
+	// maximum number of cached hosts, 0 means no limit. Expired entries
+	// are dropped as the cache grows either way
+	MaxEntries int
+}
+
+type DNSCacheStats struct {
+	Hits         uint64
+	Misses       uint64
+	NegativeHits uint64
+	Entries      int
+}
+
+// DNSCache is a Resolver caching the answers of another Resolver. It can be
+// shared by several clients and dialers.
+//
+// Besides the addresses, the cache stores whether the policy of each client
+// allowed or denied them. A denied address is rejected without connecting
+// to it until the entry expires, an allowed address is still checked again
+// when it is dialed, so caching doesn't weaken the DNS rebinding protection.
+type DNSCache struct {
+	resolver Resolver
+	options  DNSCacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry
+	// size at which an unbounded cache sweeps its expired entries, doubled
+	// after every sweep so storing stays cheap
+	sweepAt int
+
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	negativeHits atomic.Uint64
+
+	// replaced in tests
+	now func() time.Time
+}
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+
+	// verdicts of the addresses per policy, keyed by *Config and ip
+	verdicts sync.Map
+}
+
+type dnsVerdictKey struct {
+	config *Config
+	ip     string
+}
+
+func NewDNSCache(resolver Resolver, options DNSCacheOptions) *DNSCache {
+	if options.DefaultTTL <= 0 {
+		options.DefaultTTL = time.Minute
+	}
+
+	return &DNSCache{
+		resolver: resolver,
+		options:  options,
+		entries:  make(map[string]*dnsCacheEntry),
+		now:      time.Now,
+	}
+}
+
+func (c *DNSCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	entry, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return entry.addrs, nil
+}
+
+func (c *DNSCache) lookup(ctx context.Context, host string) (*dnsCacheEntry, error) {
+	host = normalizeHost(host)
+
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	if ok && c.now().Before(entry.expires) {
+		c.mu.Unlock()
+
+		if entry.err != nil {
+			c.negativeHits.Add(1)
+			return nil, entry.err
+		}
+		c.hits.Add(1)
+		return entry, nil
+	}
+	c.mu.Unlock()
+
+	c.misses.Add(1)
+
+	addrs, ttl, err := c.resolve(ctx, host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if c.options.NegativeTTL > 0 && errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			c.store(host, &dnsCacheEntry{err: err, expires: c.now().Add(c.options.NegativeTTL)})
+		}
+		return nil, err
+	}
+
+	entry = &dnsCacheEntry{addrs: addrs, expires: c.now().Add(ttl)}
+	if ttl > 0 {
+		c.store(host, entry)
+	}
+	return entry, nil
+}
+
+func (c *DNSCache) resolve(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	ttlResolver, ok := c.resolver.(TTLResolver)
+	if !ok {
+		addrs, err := c.resolver.LookupIPAddr(ctx, host)
+		return addrs, c.boundTTL(c.options.DefaultTTL), err
+	}
+
+	addrs, ttl, err := ttlResolver.LookupIPAddrTTL(ctx, host)
+	return addrs, c.boundTTL(ttl), err
+}
+
+func (c *DNSCache) boundTTL(ttl time.Duration) time.Duration {
+	if ttl < c.options.MinTTL {
+		ttl = c.options.MinTTL
+	}
+	if c.options.MaxTTL > 0 && ttl > c.options.MaxTTL {
+		ttl = c.options.MaxTTL
+	}
+	return ttl
+}
+
+func (c *DNSCache) store(host string, entry *dnsCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.options.MaxEntries > 0 && len(c.entries) >= c.options.MaxEntries:
+		c.evict()
+	case c.options.MaxEntries <= 0 && len(c.entries) >= c.sweepAt:
+		// hosts that are never looked up again would otherwise stay
+		// forever
+		c.sweep()
+		c.sweepAt = max(2*len(c.entries), dnsCacheSweepSize)
+	}
+	c.entries[host] = entry
+}
+
+// sweep drops the expired entries. Must be called with mu held.
+func (c *DNSCache) sweep() {
+	now := c.now()
+	for host, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, host)
+		}
+	}
+}
+
+// evict drops the expired entries, or an arbitrary one if none expired.
+// Must be called with mu held.
+func (c *DNSCache) evict() {
+	c.sweep()
+
+	if len(c.entries) < c.options.MaxEntries {
+		return
+	}
+	for host := range c.entries {
+		delete(c.entries, host)
+		return
+	}
+}
+
+// isDenied reports whether the policy of config denied ip for host the last
+// time it was dialed.
+func (c *DNSCache) isDenied(host string, ip net.IP, config *Config) bool {
+	entry := c.cachedEntry(host)
+	if entry == nil {
+		return false
+	}
+
+	allowed, ok := entry.verdicts.Load(dnsVerdictKey{config: config, ip: ip.String()})
+	return ok && !allowed.(bool)
+}
+
+func (c *DNSCache) storeVerdict(host string, ip net.IP, config *Config, allowed bool) {
+	entry := c.cachedEntry(host)
+	if entry == nil {
+		return
+	}
+	entry.verdicts.Store(dnsVerdictKey{config: config, ip: ip.String()}, allowed)
+}
+
+func (c *DNSCache) cachedEntry(host string) *dnsCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[normalizeHost(host)]
+	if !ok || !c.now().Before(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+func (c *DNSCache) Stats() DNSCacheStats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return DNSCacheStats{
+		Hits:         c.hits.Load(),
+		Misses:       c.misses.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Entries:      entries,
+	}
+}
+
+// Flush drops every cached entry and verdict.
+func (c *DNSCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*dnsCacheEntry)
+}
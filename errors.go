@@ -0,0 +1,343 @@
+package safeurl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel errors for use with errors.Is. Every policy error matches
+// ErrPolicyViolation in addition to its specific sentinel.
+var (
+	ErrPolicyViolation = errors.New("safeurl: policy violation")
+
+	ErrCredentialsBlocked   = errors.New("safeurl: sending credentials blocked")
+	ErrSchemeNotAllowed     = errors.New("safeurl: scheme not allowed")
+	ErrInvalidHost          = errors.New("safeurl: invalid host")
+	ErrHostNotAllowed       = errors.New("safeurl: host not allowed")
+	ErrHostBlocked          = errors.New("safeurl: host blocked")
+	ErrPortNotAllowed       = errors.New("safeurl: port not allowed")
+	ErrPortBlocked          = errors.New("safeurl: port blocked")
+	ErrSchemePortNotAllowed = errors.New("safeurl: port not allowed for scheme")
+	ErrIPNotAllowed         = errors.New("safeurl: ip not allowed")
+	ErrIPBlocked            = errors.New("safeurl: ip blocked")
+	ErrIPv6Blocked          = errors.New("safeurl: ipv6 blocked")
+	ErrInvalidAddress       = errors.New("safeurl: invalid address")
+)
+
+// Sentinel errors for responses exceeding the configured limits. They are not
+// policy violations and don't match ErrPolicyViolation.
+var (
+	ErrResponseBodyTooLarge     = errors.New("safeurl: response body too large")
+	ErrResponseHeaderTooLarge   = errors.New("safeurl: response header too large")
+	ErrDecompressedBodyTooLarge = errors.New("safeurl: decompressed response body too large")
+)
+
+// PolicyViolation is implemented by every error returned when a target is
+// rejected by the policy. It can be extracted from the errors returned by
+// the client and the dialer with errors.As:
+//
+//	var violation safeurl.PolicyViolation
+//	if errors.As(err, &violation) {
+//		log.Printf("blocked by %v: %v", violation.Rule(), violation.Value())
+//	}
+type PolicyViolation interface {
+	error
+
+	// Rule is the part of the policy that rejected the target.
+	Rule() Rule
+	// Value is the offending value, e.g. the scheme, host, port or ip.
+	Value() string
+	// Addr is the resolved "ip:port" being dialed, empty for violations
+	// detected before resolution.
+	Addr() string
+	// Hop is the index of the request in a redirect chain, 0 for the
+	// initial request.
+	Hop() int
+}
+
+type violation struct {
+	rule  Rule
+	value string
+	addr  string
+	hop   int
+}
+
+func (v *violation) Rule() Rule {
+	return v.rule
+}
+
+func (v *violation) Value() string {
+	return v.value
+}
+
+func (v *violation) Addr() string {
+	return v.addr
+}
+
+func (v *violation) Hop() int {
+	return v.hop
+}
+
+func (v *violation) setHop(hop int) {
+	v.hop = hop
+}
+
+func setViolationHop(err error, hop int) {
+	var v interface{ setHop(int) }
+	if errors.As(err, &v) {
+		v.setHop(hop)
+	}
+}
+
+type AllowedPortError struct {
+	violation
+}
+
+func (e *AllowedPortError) Error() string {
+	return fmt.Sprintf("port: %v not found in allowlist", e.value)
+}
+
+func (e *AllowedPortError) Is(target error) bool {
+	return target == ErrPortNotAllowed || target == ErrPolicyViolation
+}
+
+type BlockedPortError struct {
+	violation
+}
+
+func (e *BlockedPortError) Error() string {
+	return fmt.Sprintf("port: %v found in blocklist", e.value)
+}
+
+func (e *BlockedPortError) Is(target error) bool {
+	return target == ErrPortBlocked || target == ErrPolicyViolation
+}
+
+type AllowedSchemePortError struct {
+	violation
+	scheme string
+}
+
+func (e *AllowedSchemePortError) Error() string {
+	return fmt.Sprintf("port: %v not found in allowlist for scheme: %v", e.value, e.scheme)
+}
+
+func (e *AllowedSchemePortError) Is(target error) bool {
+	return target == ErrSchemePortNotAllowed || target == ErrPolicyViolation
+}
+
+type AllowedSchemeError struct {
+	violation
+}
+
+func (e *AllowedSchemeError) Error() string {
+	return fmt.Sprintf("scheme: %v not found in allowlist", e.value)
+}
+
+func (e *AllowedSchemeError) Is(target error) bool {
+	return target == ErrSchemeNotAllowed || target == ErrPolicyViolation
+}
+
+type InvalidHostError struct {
+	violation
+}
+
+func (e *InvalidHostError) Error() string {
+	return fmt.Sprintf("host: %v is not valid", e.value)
+}
+
+func (e *InvalidHostError) Is(target error) bool {
+	return target == ErrInvalidHost || target == ErrPolicyViolation
+}
+
+type AllowedHostError struct {
+	violation
+}
+
+func (e *AllowedHostError) Error() string {
+	return fmt.Sprintf("host: %v not found in allowlist", e.value)
+}
+
+func (e *AllowedHostError) Is(target error) bool {
+	return target == ErrHostNotAllowed || target == ErrPolicyViolation
+}
+
+type BlockedHostError struct {
+	violation
+}
+
+func (e *BlockedHostError) Error() string {
+	return fmt.Sprintf("host: %v found in blocklist", e.value)
+}
+
+func (e *BlockedHostError) Is(target error) bool {
+	return target == ErrHostBlocked || target == ErrPolicyViolation
+}
+
+// AllowedIPError is returned when an ip allowlist is configured and the
+// target ip is not on it.
+type AllowedIPError struct {
+	violation
+}
+
+func (e *AllowedIPError) Error() string {
+	return fmt.Sprintf("ip: %v not found in allowlist", e.value)
+}
+
+func (e *AllowedIPError) Is(target error) bool {
+	return target == ErrIPNotAllowed || target == ErrPolicyViolation
+}
+
+// BlockedIPError is returned when the target ip is on the configured
+// blocklist or in one of the private networks. Rule tells the two apart.
+type BlockedIPError struct {
+	violation
+}
+
+func (e *BlockedIPError) Error() string {
+	if e.rule == RulePrivateNetworks {
+		return fmt.Sprintf("ip: %v found in private networks", e.value)
+	}
+	return fmt.Sprintf("ip: %v found in blocklist", e.value)
+}
+
+func (e *BlockedIPError) Is(target error) bool {
+	return target == ErrIPBlocked || target == ErrPolicyViolation
+}
+
+type IPv6BlockedError struct {
+	violation
+}
+
+func (e *IPv6BlockedError) Error() string {
+	return fmt.Sprintf("ipv6 blocked. connection to %v dropped", e.addr)
+}
+
+func (e *IPv6BlockedError) Is(target error) bool {
+	return target == ErrIPv6Blocked || target == ErrPolicyViolation
+}
+
+type SendingCredentialsBlockedError struct {
+	violation
+}
+
+func (e *SendingCredentialsBlockedError) Error() string {
+	return "sending credentials blocked."
+}
+
+func (e *SendingCredentialsBlockedError) Is(target error) bool {
+	return target == ErrCredentialsBlocked || target == ErrPolicyViolation
+}
+
+// InvalidAddressError is returned when the address being dialed can't be
+// checked against the policy, e.g. the host is not an ip or the port is not
+// numeric.
+type InvalidAddressError struct {
+	violation
+}
+
+func (e *InvalidAddressError) Error() string {
+	return fmt.Sprintf("address: %v is not valid", e.addr)
+}
+
+func (e *InvalidAddressError) Is(target error) bool {
+	return target == ErrInvalidAddress || target == ErrPolicyViolation
+}
+
+// RedirectError wraps the error of a redirect that was rejected by the
+// policy.
+type RedirectError struct {
+	hop int
+	url string
+	err error
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("redirect #%v to %v blocked: %v", e.hop, e.url, e.err)
+}
+
+func (e *RedirectError) Hop() int {
+	return e.hop
+}
+
+func (e *RedirectError) Unwrap() error {
+	return e.err
+}
+
+type ResponseBodyTooLargeError struct {
+	limit int64
+}
+
+func (e *ResponseBodyTooLargeError) Error() string {
+	return fmt.Sprintf("response body exceeds the limit of %v bytes", e.limit)
+}
+
+func (e *ResponseBodyTooLargeError) Limit() int64 {
+	return e.limit
+}
+
+func (e *ResponseBodyTooLargeError) Is(target error) bool {
+	return target == ErrResponseBodyTooLarge
+}
+
+type ResponseHeaderTooLargeError struct {
+	limit int64
+}
+
+func (e *ResponseHeaderTooLargeError) Error() string {
+	return fmt.Sprintf("response header exceeds the limit of %v bytes", e.limit)
+}
+
+func (e *ResponseHeaderTooLargeError) Limit() int64 {
+	return e.limit
+}
+
+func (e *ResponseHeaderTooLargeError) Is(target error) bool {
+	return target == ErrResponseHeaderTooLarge
+}
+
+type DecompressedBodyTooLargeError struct {
+	limit int64
+}
+
+func (e *DecompressedBodyTooLargeError) Error() string {
+	return fmt.Sprintf("decompressed response body exceeds the limit of %v bytes", e.limit)
+}
+
+func (e *DecompressedBodyTooLargeError) Limit() int64 {
+	return e.limit
+}
+
+func (e *DecompressedBodyTooLargeError) Is(target error) bool {
+	return target == ErrDecompressedBodyTooLarge
+}
+
+// ConfigError lists every invalid entry found while building a Config.
+type ConfigError struct {
+	Errors []error
+}
+
+func (e *ConfigError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("invalid config: %v", strings.Join(msgs, "; "))
+}
+
+func (e *ConfigError) Unwrap() []error {
+	return e.Errors
+}
+
+func unwrap(err error) error {
+	wrapped, ok := err.(interface{ Unwrap() error })
+	if !ok {
+		return err
+	}
+	inner := wrapped.Unwrap()
+	if inner == nil {
+		return err
+	}
+	return unwrap(inner)
+}
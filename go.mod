@@ -2,11 +2,14 @@ module github.com/doyensec/safeurl
 
 go 1.24.0
 
-require github.com/miekg/dns v1.1.66
+require (
+	github.com/miekg/dns v1.1.66
+	golang.org/x/net v0.39.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	golang.org/x/mod v0.24.0 // indirect
-	golang.org/x/net v0.39.0 // indirect
 	golang.org/x/sync v0.13.0 // indirect
 	golang.org/x/sys v0.32.0 // indirect
 	golang.org/x/tools v0.32.0 // indirect
@@ -2,12 +2,39 @@ package safeurl
 
 import "strings"
 
+// isAllowedHost reports whether host matches any of the entries. An entry is
+// either an exact hostname, a wildcard such as "*.example.com" matching any
+// subdomain but not the apex, or a suffix such as ".example.com" matching the
+// apex and any subdomain.
 func isAllowedHost(host string, allowedHosts []string) bool {
-	host = strings.ToLower(host)
-	for _, allowedHost := range allowedHosts {
-		if host == allowedHost {
+	return isHostInList(host, allowedHosts)
+}
+
+func isBlockedHost(host string, blockedHosts []string) bool {
+	return isHostInList(host, blockedHosts)
+}
+
+func isHostInList(host string, hosts []string) bool {
+	host = normalizeHost(host)
+	for _, entry := range hosts {
+		if matchHost(host, entry) {
 			return true
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+func matchHost(host string, entry string) bool {
+	switch {
+	case strings.HasPrefix(entry, "*."):
+		return strings.HasSuffix(host, entry[1:])
+	case strings.HasPrefix(entry, "."):
+		return host == entry[1:] || strings.HasSuffix(host, entry)
+	default:
+		return host == entry
+	}
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
@@ -3,91 +3,151 @@ package safeurl
 import (
 	"fmt"
 	"net"
+	"strings"
 )
 
 // private CIDRs to ignore
 var privateNetworks = []net.IPNet{
 	// ipv4 sourced form https://www.rfc-editor.org/rfc/rfc5735
-	parseCIDR("10.0.0.0/8"),         /* Private network - RFC 1918 */
-	parseCIDR("172.16.0.0/12"),      /* Private network - RFC 1918 */
-	parseCIDR("192.168.0.0/16"),     /* Private network - RFC 1918 */
-	parseCIDR("127.0.0.0/8"),        /* Loopback - RFC 1122, Section 3.2.1.3 */
-	parseCIDR("0.0.0.0/8"),          /* Current network (only valid as source address) - RFC 1122, Section 3.2.1.3 */
-	parseCIDR("169.254.0.0/16"),     /* Link-local - RFC 3927 */
-	parseCIDR("192.0.0.0/24"),       /* IETF Protocol Assignments - RFC 5736 */
-	parseCIDR("192.0.2.0/24"),       /* TEST-NET-1, documentation and examples - RFC 5737 */
-	parseCIDR("198.51.100.0/24"),    /* TEST-NET-2, documentation and examples - RFC 5737 */
-	parseCIDR("203.0.113.0/24"),     /* TEST-NET-3, documentation and examples - RFC 5737 */
-	parseCIDR("192.88.99.0/24"),     /* IPv6 to IPv4 relay (includes 2002::/16) - RFC 3068 */
-	parseCIDR("198.18.0.0/15"),      /* Network benchmark tests - RFC 2544 */
-	parseCIDR("224.0.0.0/4"),        /* IP multicast (former Class D network) - RFC 3171 */
-	parseCIDR("240.0.0.0/4"),        /* Reserved (former Class E network) - RFC 1112, Section 4 */
-	parseCIDR("255.255.255.255/32"), /* Broadcast - RFC 919, Section 7 */
-	parseCIDR("100.64.0.0/10"),      /* Shared Address Space - RFC 6598 */
+	mustParseCIDR("10.0.0.0/8"),         /* Private network - RFC 1918 */
+	mustParseCIDR("172.16.0.0/12"),      /* Private network - RFC 1918 */
+	mustParseCIDR("192.168.0.0/16"),     /* Private network - RFC 1918 */
+	mustParseCIDR("127.0.0.0/8"),        /* Loopback - RFC 1122, Section 3.2.1.3 */
+	mustParseCIDR("0.0.0.0/8"),          /* Current network (only valid as source address) - RFC 1122, Section 3.2.1.3 */
+	mustParseCIDR("169.254.0.0/16"),     /* Link-local - RFC 3927 */
+	mustParseCIDR("192.0.0.0/24"),       /* IETF Protocol Assignments - RFC 5736 */
+	mustParseCIDR("192.0.2.0/24"),       /* TEST-NET-1, documentation and examples - RFC 5737 */
+	mustParseCIDR("198.51.100.0/24"),    /* TEST-NET-2, documentation and examples - RFC 5737 */
+	mustParseCIDR("203.0.113.0/24"),     /* TEST-NET-3, documentation and examples - RFC 5737 */
+	mustParseCIDR("192.88.99.0/24"),     /* IPv6 to IPv4 relay (includes 2002::/16) - RFC 3068 */
+	mustParseCIDR("198.18.0.0/15"),      /* Network benchmark tests - RFC 2544 */
+	mustParseCIDR("224.0.0.0/4"),        /* IP multicast (former Class D network) - RFC 3171 */
+	mustParseCIDR("240.0.0.0/4"),        /* Reserved (former Class E network) - RFC 1112, Section 4 */
+	mustParseCIDR("255.255.255.255/32"), /* Broadcast - RFC 919, Section 7 */
+	mustParseCIDR("100.64.0.0/10"),      /* Shared Address Space - RFC 6598 */
 	// ipv6 sourced from https://www.iana.org/assignments/iana-ipv6-special-registry/iana-ipv6-special-registry.xhtml
-	parseCIDR("::/128"),        /* Unspecified Address - RFC 4291 */
-	parseCIDR("::1/128"),       /* Loopback - RFC 4291 */
-	parseCIDR("100::/64"),      /* Discard prefix - RFC 6666 */
-	parseCIDR("2001::/23"),     /* IETF Protocol Assignments - RFC 2928 */
-	parseCIDR("2001:2::/48"),   /* Benchmarking - RFC5180 */
-	parseCIDR("2001:db8::/32"), /* Addresses used in documentation and example source code - RFC 3849 */
-	parseCIDR("2001::/32"),     /* Teredo tunneling - RFC4380 - RFC8190 */
-	parseCIDR("fc00::/7"),      /* Unique local address - RFC 4193 - RFC 8190 */
-	parseCIDR("fe80::/10"),     /* Link-local address - RFC 4291 */
-	parseCIDR("ff00::/8"),      /* Multicast - RFC 3513 */
-	parseCIDR("2002::/16"),     /* 6to4 - RFC 3056 */
-	parseCIDR("64:ff9b::/96"),  /* IPv4/IPv6 translation - RFC 6052 */
-	parseCIDR("2001:10::/28"),  /* Deprecated (previously ORCHID) - RFC 4843 */
-	parseCIDR("2001:20::/28"),  /* ORCHIDv2 - RFC7343 */
+	mustParseCIDR("::/128"),         /* Unspecified Address - RFC 4291 */
+	mustParseCIDR("::1/128"),        /* Loopback - RFC 4291 */
+	mustParseCIDR("100::/64"),       /* Discard prefix - RFC 6666 */
+	mustParseCIDR("2001::/23"),      /* IETF Protocol Assignments - RFC 2928 */
+	mustParseCIDR("2001:2::/48"),    /* Benchmarking - RFC5180 */
+	mustParseCIDR("2001:db8::/32"),  /* Addresses used in documentation and example source code - RFC 3849 */
+	mustParseCIDR("2001::/32"),      /* Teredo tunneling - RFC4380 - RFC8190 */
+	mustParseCIDR("fc00::/7"),       /* Unique local address - RFC 4193 - RFC 8190 */
+	mustParseCIDR("fe80::/10"),      /* Link-local address - RFC 4291 */
+	mustParseCIDR("ff00::/8"),       /* Multicast - RFC 3513 */
+	mustParseCIDR("2002::/16"),      /* 6to4 - RFC 3056 */
+	mustParseCIDR("64:ff9b::/96"),   /* IPv4/IPv6 translation - RFC 6052 */
+	mustParseCIDR("64:ff9b:1::/48"), /* Local-use IPv4/IPv6 translation - RFC 8215 */
+	mustParseCIDR("2001:10::/28"),   /* Deprecated (previously ORCHID) - RFC 4843 */
+	mustParseCIDR("2001:20::/28"),   /* ORCHIDv2 - RFC7343 */
 }
 
-func parseCIDR(network string) net.IPNet {
-	_, net, err := net.ParseCIDR(network)
+var privateNetworkSet = func() *prefixSet {
+	s := &prefixSet{}
+	for _, ipNet := range privateNetworks {
+		s.insert(ipNetToPrefix(ipNet))
+	}
+	return s
+}()
+
+// ipv6 prefixes embedding an ipv4 address, see embeddedIPv4
+var (
+	sixToFourNetwork      = mustParseCIDR("2002::/16")
+	nat64Network          = mustParseCIDR("64:ff9b::/96")
+	nat64LocalNetwork     = mustParseCIDR("64:ff9b:1::/48")
+	teredoNetwork         = mustParseCIDR("2001::/32")
+	ipv4CompatibleNetwork = mustParseCIDR("::/96")
+)
+
+func mustParseCIDR(network string) net.IPNet {
+	parsed, err := parseCIDR(network)
 	if err != nil {
-		panic(fmt.Sprintf("error parsing %v: %v", network, err))
+		panic(err.Error())
 	}
-	return *net
+	return parsed
 }
 
-func parseIP(ip string) net.IP {
-	parsed := net.ParseIP(ip)
+func parseCIDR(network string) (net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(strings.TrimSpace(network))
+	if err != nil {
+		return net.IPNet{}, fmt.Errorf("error parsing %v: %v", network, err)
+	}
+	return *ipNet, nil
+}
+
+func parseIP(ip string) (net.IP, error) {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
 	if parsed == nil {
-		panic(fmt.Sprintf("error parsing ip: %v", ip))
+		return nil, fmt.Errorf("error parsing ip: %v", ip)
 	}
-	return parsed
+	return parsed, nil
 }
 
-func isIPBlocked(ip net.IP, blockedIPs []net.IP, blockedIPsCIDR []net.IPNet) bool {
-	for _, blockedIP := range blockedIPs {
-		if blockedIP.Equal(ip) {
-			return true
-		}
+func isIPAllowed(ip net.IP, allowedIPs []net.IP, allowedIPsCIDR []net.IPNet) bool {
+	return isIPInList(ip, allowedIPs, allowedIPsCIDR)
+}
+
+// embeddedIPv4 returns the ipv4 addresses embedded in a 6to4, nat64, teredo
+// or ipv4-compatible address, or nil if ip isn't one of them or the address
+// can't be read unambiguously. Teredo addresses embed both the server and
+// the client address.
+func embeddedIPv4(ip net.IP) []net.IP {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
 	}
-	for _, blockedNet := range blockedIPsCIDR {
-		if blockedNet.Contains(ip) {
-			return true
+
+	switch {
+	case nat64Network.Contains(ip), ipv4CompatibleNetwork.Contains(ip):
+		return []net.IP{net.IPv4(ip[12], ip[13], ip[14], ip[15])}
+	case nat64LocalNetwork.Contains(ip):
+		// RFC 8215 lets operators use any prefix length inside the /48. The
+		// /48 format of RFC 6052 section 2.2 skips bits 64 to 71 and leaves
+		// the suffix zero, the /96 format leaves bits 48 to 95 zero. Other
+		// layouts are left to the private networks check, which blocks the
+		// whole prefix.
+		switch {
+		case ip[8] == 0 && isZero(ip[11:]):
+			return []net.IP{net.IPv4(ip[6], ip[7], ip[9], ip[10])}
+		case isZero(ip[6:12]):
+			return []net.IP{net.IPv4(ip[12], ip[13], ip[14], ip[15])}
+		}
+		return nil
+	case sixToFourNetwork.Contains(ip):
+		return []net.IP{net.IPv4(ip[2], ip[3], ip[4], ip[5])}
+	case teredoNetwork.Contains(ip):
+		// RFC 4380 section 4: the client address is stored inverted
+		return []net.IP{
+			net.IPv4(ip[4], ip[5], ip[6], ip[7]),
+			net.IPv4(ip[12]^0xff, ip[13]^0xff, ip[14]^0xff, ip[15]^0xff),
 		}
 	}
-	for _, net := range privateNetworks {
-		if net.Contains(ip) {
-			return true
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
 		}
 	}
+	return true
+}
 
-	return false
+func isIPPrivate(ip net.IP) bool {
+	return privateNetworkSet.containsIP(ip)
 }
 
-func isIPAllowed(ip net.IP, allowedIPs []net.IP, allowedIPsCIDR []net.IPNet) bool {
-	for _, allowedIP := range allowedIPs {
-		if ip.Equal(allowedIP) {
+func isIPInList(ip net.IP, ips []net.IP, ipsCIDR []net.IPNet) bool {
+	for _, listedIP := range ips {
+		if ip.Equal(listedIP) {
 			return true
 		}
 	}
-	for _, allowedNet := range allowedIPsCIDR {
-		if allowedNet.Contains(ip) {
+	for _, listedNet := range ipsCIDR {
+		if listedNet.Contains(ip) {
 			return true
 		}
 	}
-
 	return false
-}
\ No newline at end of file
+}
@@ -0,0 +1,163 @@
+package safeurl
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	urllib "net/url"
+	"strings"
+)
+
+// prefix of the error returned by http.Transport when MaxResponseHeaderBytes
+// is exceeded, it isn't exported as a typed error
+const headerLimitErrorPrefix = "net/http: server response headers exceeded"
+
+// shouldDecompress reports whether the client handles gzip itself instead of
+// http.Transport, so the body limit counts the bytes received and the
+// decompressed size can be limited.
+func shouldDecompress(config *Config) bool {
+	return config.MaxResponseBodySize > 0 || config.MaxDecompressedSize > 0
+}
+
+// prepareLimitedRequest asks for a gzip response when the client handles
+// decompression itself, mirroring what http.Transport does when its
+// compression is enabled.
+func prepareLimitedRequest(req *http.Request, config *Config) *http.Request {
+	if !shouldDecompress(config) || req.Method == "HEAD" {
+		return req
+	}
+	if req.Header.Get("Accept-Encoding") != "" || req.Header.Get("Range") != "" {
+		return req
+	}
+
+	req.Header = req.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	// mark the request so the response is only decompressed when the client
+	// asked for compression, not the caller
+	req = req.WithContext(withRequestState(req.Context()))
+	getRequestState(req.Context()).requestedGzip = true
+	return req
+}
+
+// limitResponse wraps resp.Body so reading past the configured limits fails
+// with a typed error. Responses that announce a body larger than the limit
+// are rejected right away. Responses without a body, like the ones to HEAD
+// requests, are returned as is even though they announce a length.
+func limitResponse(resp *http.Response, config *Config) (*http.Response, error) {
+	if resp.Body == http.NoBody || resp.Request.Method == http.MethodHead {
+		return resp, nil
+	}
+
+	if config.MaxResponseBodySize > 0 {
+		if resp.ContentLength > config.MaxResponseBodySize {
+			resp.Body.Close()
+			return nil, &ResponseBodyTooLargeError{limit: config.MaxResponseBodySize}
+		}
+
+		resp.Body = &limitedBody{
+			body:      resp.Body,
+			remaining: config.MaxResponseBodySize,
+			err:       &ResponseBodyTooLargeError{limit: config.MaxResponseBodySize},
+		}
+	}
+
+	state := getRequestState(resp.Request.Context())
+	requestedGzip := state != nil && state.requestedGzip
+
+	if requestedGzip && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		resp.Body = &gzipBody{body: resp.Body}
+		if config.MaxDecompressedSize > 0 {
+			resp.Body = &limitedBody{
+				body:      resp.Body,
+				remaining: config.MaxDecompressedSize,
+				err:       &DecompressedBodyTooLargeError{limit: config.MaxDecompressedSize},
+			}
+		}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+
+	return resp, nil
+}
+
+// wrapHeaderLimitError replaces the untyped error http.Transport returns for
+// oversized response headers with a *ResponseHeaderTooLargeError.
+func wrapHeaderLimitError(err error, config *Config) error {
+	if config.MaxResponseHeaderBytes <= 0 || !strings.Contains(err.Error(), headerLimitErrorPrefix) {
+		return err
+	}
+
+	limitErr := &ResponseHeaderTooLargeError{limit: config.MaxResponseHeaderBytes}
+
+	var urlErr *urllib.Error
+	if errors.As(err, &urlErr) {
+		urlErr.Err = limitErr
+		return urlErr
+	}
+
+	return limitErr
+}
+
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.err
+	}
+
+	// read one byte past the limit to tell a body of exactly the limit
+	// apart from a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n - 1, b.err
+	}
+
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// gzipBody defers reading the gzip header until the first Read, so a slow or
+// malicious server can't block Do.
+type gzipBody struct {
+	body   io.ReadCloser
+	reader *gzip.Reader
+	err    error
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+
+	if g.reader == nil {
+		g.reader, g.err = gzip.NewReader(g.body)
+		if g.err != nil {
+			return 0, g.err
+		}
+	}
+
+	return g.reader.Read(p)
+}
+
+func (g *gzipBody) Close() error {
+	return g.body.Close()
+}
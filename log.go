@@ -0,0 +1,74 @@
+package safeurl
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// attribute keys used in the records emitted at every decision point
+const (
+	LogKeyURL      = "url"
+	LogKeyHost     = "host"
+	LogKeyIP       = "ip"
+	LogKeyPort     = "port"
+	LogKeyRule     = "rule"
+	LogKeyDecision = "decision"
+)
+
+// values of the LogKeyDecision attribute
+const (
+	DecisionAllow   = "allow"
+	DecisionDeny    = "deny"
+	DecisionMonitor = "monitor"
+)
+
+// buildLogger returns the logger configured in config. Allowed targets are
+// logged at info level, denied ones at warn level and internal errors at
+// error level. If no logger is set, IsDebugLoggingEnabled writes all records
+// to stdout, otherwise nothing is logged.
+func buildLogger(config *Config) *slog.Logger {
+	if config.Logger != nil {
+		return config.Logger.With(slog.String("component", "safeurl"))
+	}
+
+	if config.IsDebugLoggingEnabled {
+		handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+		return slog.New(handler).With(slog.String("component", "safeurl"))
+	}
+
+	return slog.New(slog.DiscardHandler)
+}
+
+func logAllowed(ctx context.Context, logger *slog.Logger, msg string, rule Rule, attrs ...slog.Attr) {
+	attrs = append(attrs, slog.String(LogKeyDecision, DecisionAllow))
+	if rule != "" {
+		attrs = append(attrs, slog.String(LogKeyRule, string(rule)))
+	}
+	logger.LogAttrs(ctx, slog.LevelInfo, msg, attrs...)
+}
+
+func logBlocked(ctx context.Context, logger *slog.Logger, msg string, rule Rule, err error, attrs ...slog.Attr) {
+	attrs = append(attrs,
+		slog.String(LogKeyDecision, DecisionDeny),
+		slog.String(LogKeyRule, string(rule)),
+		slog.String("error", err.Error()),
+	)
+	logger.LogAttrs(ctx, slog.LevelWarn, msg, attrs...)
+}
+
+// logMonitored logs a violation of a rule in monitor mode, which would have
+// been blocked in enforce mode.
+func logMonitored(ctx context.Context, logger *slog.Logger, msg string, rule Rule, err error, attrs ...slog.Attr) {
+	attrs = append(attrs,
+		slog.String(LogKeyDecision, DecisionMonitor),
+		slog.String(LogKeyRule, string(rule)),
+		slog.String("error", err.Error()),
+	)
+	logger.LogAttrs(ctx, slog.LevelWarn, msg, attrs...)
+}
+
+func logError(ctx context.Context, logger *slog.Logger, msg string, err error, attrs ...slog.Attr) {
+	attrs = append(attrs, slog.String("error", err.Error()))
+	logger.LogAttrs(ctx, slog.LevelError, msg, attrs...)
+}
@@ -0,0 +1,79 @@
+package safeurl
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Metrics receives the measurements of a client and its dialer. It can be
+// backed by Prometheus, OpenTelemetry or any other system. Implementations
+// must be safe for concurrent use.
+type Metrics interface {
+	// IncRequests counts a request sent with WrappedClient.Do.
+	IncRequests()
+	// IncBlocked counts a request blocked by the policy. reason is one of
+	// the Reason constants, rule is the rule that fired.
+	IncBlocked(reason string, rule Rule)
+	// ObserveResolution records the duration of a host lookup.
+	ObserveResolution(duration time.Duration, err error)
+	// ObserveDial records the latency of a connection attempt.
+	ObserveDial(duration time.Duration, err error)
+}
+
+// reasons passed to Metrics.IncBlocked
+const (
+	ReasonScheme      = "scheme"
+	ReasonHost        = "host"
+	ReasonPort        = "port"
+	ReasonIP          = "ip"
+	ReasonCIDR        = "cidr"
+	ReasonIPv6        = "ipv6"
+	ReasonCredentials = "credentials"
+	// the violation happened while following a redirect
+	ReasonRedirect = "redirect"
+	// malformed addresses and unsupported networks
+	ReasonInvalid = "invalid"
+)
+
+// recordRequest counts a request and, if err is a violation, the reason it
+// was blocked.
+func recordRequest(metrics Metrics, config *Config, err error) {
+	metrics.IncRequests()
+
+	var violation PolicyViolation
+	if errors.As(err, &violation) {
+		metrics.IncBlocked(blockReason(violation, config), violation.Rule())
+	}
+}
+
+func blockReason(violation PolicyViolation, config *Config) string {
+	if violation.Hop() > 0 {
+		return ReasonRedirect
+	}
+
+	switch violation.Rule() {
+	case RuleAllowedSchemes:
+		return ReasonScheme
+	case RuleAllowedHosts, RuleBlockedHosts, RuleInvalidHost:
+		return ReasonHost
+	case RuleAllowedPorts, RuleBlockedPorts, RuleAllowedSchemePorts:
+		return ReasonPort
+	case RuleIPv6:
+		return ReasonIPv6
+	case RuleCredentials:
+		return ReasonCredentials
+	case RulePrivateNetworks:
+		return ReasonCIDR
+	case RuleAllowedIPs:
+		return ReasonIP
+	case RuleBlockedIPs:
+		// blocked by an exact entry rather than a range
+		ip := net.ParseIP(violation.Value())
+		if ip != nil && isIPInList(ip, config.BlockedIPs, nil) {
+			return ReasonIP
+		}
+		return ReasonCIDR
+	}
+	return ReasonInvalid
+}
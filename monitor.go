@@ -0,0 +1,67 @@
+package safeurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// EnforcementMode decides what happens when a rule is violated.
+type EnforcementMode int
+
+const (
+	// ModeEnforce blocks the request or connection.
+	ModeEnforce EnforcementMode = iota
+	// ModeMonitor reports the violation and lets the request proceed, so a
+	// stricter policy can be rolled out safely.
+	ModeMonitor
+)
+
+func (m EnforcementMode) String() string {
+	switch m {
+	case ModeEnforce:
+		return "enforce"
+	case ModeMonitor:
+		return "monitor"
+	}
+	return fmt.Sprintf("EnforcementMode(%d)", int(m))
+}
+
+// isMonitored reports whether violations of rule are only reported.
+// Malformed addresses and unsupported networks are always blocked.
+func (c *Config) isMonitored(rule Rule) bool {
+	if rule == RuleInvalidAddress || rule == RuleNetwork {
+		return false
+	}
+
+	mode, ok := c.RuleModes[rule]
+	if !ok {
+		mode = c.EnforcementMode
+	}
+	return mode == ModeMonitor
+}
+
+// enforce logs a violation of the rule of decision and returns err, or
+// reports it and returns nil if the rule is in monitor mode.
+func enforce(ctx context.Context, config *Config, logger *slog.Logger, msg string, decision Decision, err error, attrs ...slog.Attr) error {
+	rule := decision.Rule
+	if !config.isMonitored(rule) {
+		logBlocked(ctx, logger, msg, rule, err, attrs...)
+		emitDecision(ctx, config, decision, DecisionDeny, err)
+		return err
+	}
+
+	if state := getRequestState(ctx); state != nil {
+		setViolationHop(err, state.getHop())
+	}
+
+	logMonitored(ctx, logger, msg, rule, err, attrs...)
+	emitDecision(ctx, config, decision, DecisionMonitor, err)
+
+	var violation PolicyViolation
+	if config.MonitorFunc != nil && errors.As(err, &violation) {
+		config.MonitorFunc(ctx, violation)
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+package safeurl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyVersion is the version of the policy document format.
+const PolicyVersion = 1
+
+// Policy is the data form of the allow and block lists of a Config. It only
+// holds the policy, runtime settings such as the logger, resolver or timeout
+// are set on the builder returned by ConfigBuilder.
+type Policy struct {
+	Version int `json:"version" yaml:"version"`
+
+	AllowedSchemes []string `json:"allowed_schemes,omitempty" yaml:"allowed_schemes,omitempty"`
+	AllowedHosts   []string `json:"allowed_hosts,omitempty" yaml:"allowed_hosts,omitempty"`
+	BlockedHosts   []string `json:"blocked_hosts,omitempty" yaml:"blocked_hosts,omitempty"`
+
+	AllowedPorts       []int               `json:"allowed_ports,omitempty" yaml:"allowed_ports,omitempty"`
+	AllowedPortRanges  []string            `json:"allowed_port_ranges,omitempty" yaml:"allowed_port_ranges,omitempty"`
+	BlockedPorts       []int               `json:"blocked_ports,omitempty" yaml:"blocked_ports,omitempty"`
+	BlockedPortRanges  []string            `json:"blocked_port_ranges,omitempty" yaml:"blocked_port_ranges,omitempty"`
+	SchemeDefaultPorts map[string]int      `json:"scheme_default_ports,omitempty" yaml:"scheme_default_ports,omitempty"`
+	AllowedSchemePorts map[string][]string `json:"allowed_scheme_ports,omitempty" yaml:"allowed_scheme_ports,omitempty"`
+
+	AllowedIPs      []string `json:"allowed_ips,omitempty" yaml:"allowed_ips,omitempty"`
+	BlockedIPs      []string `json:"blocked_ips,omitempty" yaml:"blocked_ips,omitempty"`
+	AllowedCIDRs    []string `json:"allowed_cidrs,omitempty" yaml:"allowed_cidrs,omitempty"`
+	BlockedCIDRs    []string `json:"blocked_cidrs,omitempty" yaml:"blocked_cidrs,omitempty"`
+	AllowedPrefixes []string `json:"allowed_prefixes,omitempty" yaml:"allowed_prefixes,omitempty"`
+	BlockedPrefixes []string `json:"blocked_prefixes,omitempty" yaml:"blocked_prefixes,omitempty"`
+
+	IPv6                   bool `json:"ipv6,omitempty" yaml:"ipv6,omitempty"`
+	EmbeddedIPv4Inspection bool `json:"embedded_ipv4_inspection,omitempty" yaml:"embedded_ipv4_inspection,omitempty"`
+	AllowCredentials       bool `json:"allow_credentials,omitempty" yaml:"allow_credentials,omitempty"`
+}
+
+// environment variables read by ApplyEnv, lists are comma separated
+const (
+	EnvAllowedSchemes         = "SAFEURL_ALLOWED_SCHEMES"
+	EnvAllowedHosts           = "SAFEURL_ALLOWED_HOSTS"
+	EnvBlockedHosts           = "SAFEURL_BLOCKED_HOSTS"
+	EnvAllowedPorts           = "SAFEURL_ALLOWED_PORTS"
+	EnvAllowedPortRanges      = "SAFEURL_ALLOWED_PORT_RANGES"
+	EnvBlockedPorts           = "SAFEURL_BLOCKED_PORTS"
+	EnvBlockedPortRanges      = "SAFEURL_BLOCKED_PORT_RANGES"
+	EnvAllowedIPs             = "SAFEURL_ALLOWED_IPS"
+	EnvBlockedIPs             = "SAFEURL_BLOCKED_IPS"
+	EnvAllowedCIDRs           = "SAFEURL_ALLOWED_CIDRS"
+	EnvBlockedCIDRs           = "SAFEURL_BLOCKED_CIDRS"
+	EnvAllowedPrefixes        = "SAFEURL_ALLOWED_PREFIXES"
+	EnvBlockedPrefixes        = "SAFEURL_BLOCKED_PREFIXES"
+	EnvIPv6                   = "SAFEURL_IPV6"
+	EnvEmbeddedIPv4Inspection = "SAFEURL_EMBEDDED_IPV4_INSPECTION"
+	EnvAllowCredentials       = "SAFEURL_ALLOW_CREDENTIALS"
+)
+
+// PolicyError is returned when a policy document can't be parsed. Line is 0
+// when the error can't be attributed to a line.
+type PolicyError struct {
+	Line int
+	Err  error
+}
+
+func (e *PolicyError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("policy: line %v: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("policy: %v", e.Err)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return e.Err
+}
+
+// LoadPolicyFile parses the policy document at path, as YAML if the file has
+// a .yaml or .yml extension and as JSON otherwise.
+func LoadPolicyFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return ParsePolicyYAML(data)
+	default:
+		return ParsePolicyJSON(data)
+	}
+}
+
+// ParsePolicyJSON parses a JSON policy document. Unknown fields are rejected.
+func ParsePolicyJSON(data []byte) (*Policy, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	policy := &Policy{}
+	err := decoder.Decode(policy)
+	if err != nil {
+		return nil, jsonPolicyError(data, err)
+	}
+	if decoder.More() {
+		return nil, &PolicyError{Line: lineAt(data, decoder.InputOffset()), Err: errors.New("unexpected data after the policy")}
+	}
+
+	err = policy.checkVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if key := policy.emptyAllowlist(); key != "" {
+		return nil, &PolicyError{Line: jsonKeyLine(data, key), Err: emptyAllowlistError(key)}
+	}
+	return policy, nil
+}
+
+// ParsePolicyYAML parses a YAML policy document. Unknown fields are rejected.
+func ParsePolicyYAML(data []byte) (*Policy, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	policy := &Policy{}
+	err := decoder.Decode(policy)
+	if err != nil && err != io.EOF {
+		return nil, yamlPolicyError(err)
+	}
+
+	err = policy.checkVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if key := policy.emptyAllowlist(); key != "" {
+		return nil, &PolicyError{Line: yamlKeyLine(data, key), Err: emptyAllowlistError(key)}
+	}
+	return policy, nil
+}
+
+func (p *Policy) checkVersion() error {
+	if p.Version != PolicyVersion {
+		return &PolicyError{Err: fmt.Errorf("unsupported version: %v, expected: %v", p.Version, PolicyVersion)}
+	}
+	return nil
+}
+
+// emptyAllowlist returns the key of the first allowlist the document sets to
+// an empty list. Build treats an empty allowlist like a missing one, so it
+// would allow everything instead of nothing.
+func (p *Policy) emptyAllowlist() string {
+	lists := []struct {
+		key   string
+		empty bool
+	}{
+		{"allowed_schemes", isEmptyList(p.AllowedSchemes)},
+		{"allowed_hosts", isEmptyList(p.AllowedHosts)},
+		{"allowed_ports", isEmptyList(p.AllowedPorts)},
+		{"allowed_port_ranges", isEmptyList(p.AllowedPortRanges)},
+		{"allowed_ips", isEmptyList(p.AllowedIPs)},
+		{"allowed_cidrs", isEmptyList(p.AllowedCIDRs)},
+		{"allowed_prefixes", isEmptyList(p.AllowedPrefixes)},
+	}
+	for _, list := range lists {
+		if list.empty {
+			return list.key
+		}
+	}
+	return ""
+}
+
+// isEmptyList reports whether list was set to an empty list, rather than
+// left out.
+func isEmptyList[T any](list []T) bool {
+	return list != nil && len(list) == 0
+}
+
+func emptyAllowlistError(key string) error {
+	return fmt.Errorf("%v is empty, remove it to use the default", key)
+}
+
+func jsonPolicyError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return &PolicyError{Line: lineAt(data, syntaxErr.Offset), Err: err}
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &PolicyError{Line: lineAt(data, typeErr.Offset), Err: err}
+	}
+
+	// the error for unknown fields doesn't carry an offset, find the key
+	// in the document instead
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field, _ = strconv.Unquote(field)
+		return &PolicyError{Line: jsonKeyLine(data, field), Err: err}
+	}
+
+	return &PolicyError{Err: err}
+}
+
+// jsonKeyLine returns the line of the first occurrence of key in a JSON
+// document, or 0 if it isn't found.
+func jsonKeyLine(data []byte, key string) int {
+	re := regexp.MustCompile(`"` + regexp.QuoteMeta(key) + `"\s*:`)
+	if loc := re.FindIndex(data); loc != nil {
+		return lineAt(data, int64(loc[0]))
+	}
+	return 0
+}
+
+// yamlKeyLine returns the line of a top-level key in a YAML document, or 0 if
+// it isn't found.
+func yamlKeyLine(data []byte, key string) int {
+	var doc yaml.Node
+	if yaml.Unmarshal(data, &doc) != nil || len(doc.Content) == 0 {
+		return 0
+	}
+
+	mapping := doc.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i].Line
+		}
+	}
+	return 0
+}
+
+var yamlLineRegexp = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+func yamlPolicyError(err error) error {
+	msg := err.Error()
+
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+		msg = typeErr.Errors[0]
+	}
+
+	match := yamlLineRegexp.FindStringSubmatch(msg)
+	if match == nil {
+		return &PolicyError{Err: err}
+	}
+
+	line, _ := strconv.Atoi(match[1])
+	return &PolicyError{Line: line, Err: errors.New(match[2])}
+}
+
+// lineAt returns the 1-based line of the byte at offset in data.
+func lineAt(data []byte, offset int64) int {
+	offset = min(max(offset, 0), int64(len(data)))
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// ApplyEnv overrides the policy with the SAFEURL_* environment variables
+// that are set. Empty variables are ignored, so an unset template value
+// can't clear an allowlist and widen the policy.
+func (p *Policy) ApplyEnv() error {
+	var errs []error
+
+	envList(EnvAllowedSchemes, &p.AllowedSchemes)
+	envList(EnvAllowedHosts, &p.AllowedHosts)
+	envList(EnvBlockedHosts, &p.BlockedHosts)
+	envPorts(EnvAllowedPorts, &p.AllowedPorts, &errs)
+	envList(EnvAllowedPortRanges, &p.AllowedPortRanges)
+	envPorts(EnvBlockedPorts, &p.BlockedPorts, &errs)
+	envList(EnvBlockedPortRanges, &p.BlockedPortRanges)
+	envList(EnvAllowedIPs, &p.AllowedIPs)
+	envList(EnvBlockedIPs, &p.BlockedIPs)
+	envList(EnvAllowedCIDRs, &p.AllowedCIDRs)
+	envList(EnvBlockedCIDRs, &p.BlockedCIDRs)
+	envList(EnvAllowedPrefixes, &p.AllowedPrefixes)
+	envList(EnvBlockedPrefixes, &p.BlockedPrefixes)
+	envBool(EnvIPv6, &p.IPv6, &errs)
+	envBool(EnvEmbeddedIPv4Inspection, &p.EmbeddedIPv4Inspection, &errs)
+	envBool(EnvAllowCredentials, &p.AllowCredentials, &errs)
+
+	if len(errs) > 0 {
+		return &ConfigError{Errors: errs}
+	}
+	return nil
+}
+
+func envList(name string, list *[]string) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	if items != nil {
+		*list = items
+	}
+}
+
+func envPorts(name string, ports *[]int, errs *[]error) {
+	var list []string
+	envList(name, &list)
+	if list == nil {
+		return
+	}
+
+	*ports = nil
+	for _, item := range list {
+		port, err := strconv.Atoi(item)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%v: invalid port: %v", name, item))
+			continue
+		}
+		*ports = append(*ports, port)
+	}
+}
+
+func envBool(name string, flag *bool, errs *[]error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || strings.TrimSpace(value) == "" {
+		return
+	}
+
+	parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%v: invalid boolean: %v", name, value))
+		return
+	}
+	*flag = parsed
+}
+
+// ConfigBuilder returns a builder set up with the policy. Invalid entries are
+// reported by Build and BuildE.
+func (p *Policy) ConfigBuilder() *configBuilder {
+	cb := GetConfigBuilder().
+		SetAllowedSchemes(p.AllowedSchemes...).
+		SetAllowedHosts(p.AllowedHosts...).
+		SetBlockedHosts(p.BlockedHosts...).
+		SetAllowedPorts(p.AllowedPorts...).
+		SetAllowedPortRanges(p.AllowedPortRanges...).
+		SetBlockedPorts(p.BlockedPorts...).
+		SetBlockedPortRanges(p.BlockedPortRanges...).
+		SetAllowedIPs(p.AllowedIPs...).
+		SetBlockedIPs(p.BlockedIPs...).
+		SetAllowedIPsCIDR(p.AllowedCIDRs...).
+		SetBlockedIPsCIDR(p.BlockedCIDRs...).
+		EnableIPv6(p.IPv6).
+		EnableEmbeddedIPv4Inspection(p.EmbeddedIPv4Inspection).
+		AllowSendingCredentials(p.AllowCredentials)
+
+	for scheme, port := range p.SchemeDefaultPorts {
+		cb.SetSchemeDefaultPort(scheme, port)
+	}
+	for scheme, ports := range p.AllowedSchemePorts {
+		cb.SetAllowedSchemePorts(scheme, ports...)
+	}
+
+	cb.SetAllowedPrefixes(parsePrefixStrings("allowed prefixes", p.AllowedPrefixes, &cb.errs)...)
+	cb.SetBlockedPrefixes(parsePrefixStrings("blocked prefixes", p.BlockedPrefixes, &cb.errs)...)
+
+	return cb
+}
+
+func parsePrefixStrings(field string, prefixes []string, errs *[]error) []netip.Prefix {
+	if prefixes == nil {
+		return nil
+	}
+
+	parsed := make([]netip.Prefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		parsedPrefix, err := netip.ParsePrefix(strings.TrimSpace(prefix))
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%v: %w", field, err))
+			continue
+		}
+		parsed = append(parsed, parsedPrefix)
+	}
+	return parsed
+}
+
+// PolicyFromConfig returns the policy document of config, which can be
+// marshaled to JSON or YAML and loaded back with the same allow and block
+// lists.
+func PolicyFromConfig(config *Config) *Policy {
+	p := &Policy{
+		Version: PolicyVersion,
+
+		AllowedSchemes: config.AllowedSchemes,
+		AllowedHosts:   config.AllowedHosts,
+		BlockedHosts:   config.BlockedHosts,
+		AllowedPorts:   config.AllowedPorts,
+		BlockedPorts:   config.BlockedPorts,
+
+		AllowedPortRanges: portRangeStrings(config.AllowedPortRanges),
+		BlockedPortRanges: portRangeStrings(config.BlockedPortRanges),
+
+		IPv6:                   config.IsIPv6Enabled,
+		EmbeddedIPv4Inspection: config.IsEmbeddedIPv4InspectionEnabled,
+		AllowCredentials:       config.AllowSendingCredentials,
+	}
+
+	for scheme, port := range config.SchemeDefaultPorts {
+		// the defaults of http and https are implied
+		if (scheme == "http" && port == 80) || (scheme == "https" && port == 443) {
+			continue
+		}
+		if p.SchemeDefaultPorts == nil {
+			p.SchemeDefaultPorts = make(map[string]int)
+		}
+		p.SchemeDefaultPorts[scheme] = port
+	}
+
+	if config.AllowedSchemePorts != nil {
+		p.AllowedSchemePorts = make(map[string][]string)
+		for scheme, ranges := range config.AllowedSchemePorts {
+			p.AllowedSchemePorts[scheme] = portRangeStrings(ranges)
+		}
+	}
+
+	for _, ip := range config.AllowedIPs {
+		p.AllowedIPs = append(p.AllowedIPs, ip.String())
+	}
+	for _, ip := range config.BlockedIPs {
+		p.BlockedIPs = append(p.BlockedIPs, ip.String())
+	}
+	for _, ipNet := range config.AllowedIPsCIDR {
+		p.AllowedCIDRs = append(p.AllowedCIDRs, ipNet.String())
+	}
+	for _, ipNet := range config.BlockedIPsCIDR {
+		p.BlockedCIDRs = append(p.BlockedCIDRs, ipNet.String())
+	}
+	for _, prefix := range config.AllowedPrefixes {
+		p.AllowedPrefixes = append(p.AllowedPrefixes, prefix.String())
+	}
+	for _, prefix := range config.BlockedPrefixes {
+		p.BlockedPrefixes = append(p.BlockedPrefixes, prefix.String())
+	}
+
+	return p
+}
+
+func portRangeStrings(ranges []PortRange) []string {
+	if ranges == nil {
+		return nil
+	}
+
+	strs := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		strs = append(strs, r.String())
+	}
+	return strs
+}
@@ -3,14 +3,62 @@ package safeurl
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
-func isPortAllowed(port string, allowedPorts []int) bool {
-	porti, err := strconv.Atoi(port)
+// PortRange is an inclusive range of ports. A single port is represented
+// by a range where From equals To.
+type PortRange struct {
+	From int
+	To   int
+}
+
+func (r PortRange) Contains(port int) bool {
+	return port >= r.From && port <= r.To
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(r.From)
+	}
+	return fmt.Sprintf("%v-%v", r.From, r.To)
+}
+
+// parsePortRange parses either a single port ("8080") or a range ("8000-8999").
+func parsePortRange(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+
+	fromi, err := strconv.Atoi(strings.TrimSpace(from))
 	if err != nil {
-		panic(fmt.Sprintf("failed to parse port: %v", port))
+		return PortRange{}, fmt.Errorf("invalid port range: %v", s)
+	}
+	toi, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range: %v", s)
+	}
+
+	if !isValidPort(fromi) || !isValidPort(toi) || fromi > toi {
+		return PortRange{}, fmt.Errorf("invalid port range: %v", s)
 	}
-	return _isPortAllowed(porti, allowedPorts)
+
+	return PortRange{From: fromi, To: toi}, nil
+}
+
+func isValidPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+func isPortAllowed(port int, allowedPorts []int, allowedPortRanges []PortRange) bool {
+	return _isPortAllowed(port, allowedPorts) || isPortInRanges(port, allowedPortRanges)
+}
+
+func isPortBlocked(port int, blockedPorts []int, blockedPortRanges []PortRange) bool {
+	return _isPortAllowed(port, blockedPorts) || isPortInRanges(port, blockedPortRanges)
 }
 
 func _isPortAllowed(port int, allowedPorts []int) bool {
@@ -21,3 +69,12 @@ func _isPortAllowed(port int, allowedPorts []int) bool {
 	}
 	return false
 }
+
+func isPortInRanges(port int, ranges []PortRange) bool {
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package safeurl
+
+import (
+	"math/bits"
+	"net"
+	"net/netip"
+)
+
+// prefixSet is a path-compressed binary trie of netip.Prefix. Looking up an
+// address walks at most one node per bit of the address, regardless of the
+// number of prefixes in the set.
+type prefixSet struct {
+	v4 *prefixNode
+	v6 *prefixNode
+
+	// the slice the set was built from
+	source []netip.Prefix
+}
+
+type prefixNode struct {
+	// masked prefix shared by every prefix below the node
+	prefix netip.Prefix
+	// whether prefix itself is in the set
+	terminal bool
+	children [2]*prefixNode
+}
+
+func newPrefixSet(prefixes []netip.Prefix) *prefixSet {
+	s := &prefixSet{source: prefixes}
+	for _, prefix := range prefixes {
+		s.insert(prefix)
+	}
+	return s
+}
+
+func (s *prefixSet) insert(prefix netip.Prefix) {
+	prefix = normalizePrefix(prefix)
+
+	node := &s.v6
+	if prefix.Addr().Is4() {
+		node = &s.v4
+	}
+
+	for {
+		n := *node
+		if n == nil {
+			*node = &prefixNode{prefix: prefix, terminal: true}
+			return
+		}
+
+		common := commonPrefixLen(n.prefix, prefix)
+		if common == n.prefix.Bits() {
+			if common == prefix.Bits() {
+				n.terminal = true
+				return
+			}
+			node = &n.children[addrBit(prefix.Addr(), common)]
+			continue
+		}
+
+		// the prefixes diverge above n, insert a node at the point they split
+		split := &prefixNode{prefix: netip.PrefixFrom(prefix.Addr(), common).Masked()}
+		split.children[addrBit(n.prefix.Addr(), common)] = n
+		if common == prefix.Bits() {
+			split.terminal = true
+		} else {
+			split.children[addrBit(prefix.Addr(), common)] = &prefixNode{prefix: prefix, terminal: true}
+		}
+		*node = split
+		return
+	}
+}
+
+// contains reports whether addr is in any prefix of the set. A nil set
+// contains nothing.
+func (s *prefixSet) contains(addr netip.Addr) bool {
+	if s == nil || !addr.IsValid() {
+		return false
+	}
+
+	addr = addr.Unmap()
+	n := s.v6
+	if addr.Is4() {
+		n = s.v4
+	}
+
+	for n != nil && n.prefix.Contains(addr) {
+		if n.terminal {
+			return true
+		}
+		if n.prefix.Bits() == addr.BitLen() {
+			return false
+		}
+		n = n.children[addrBit(addr, n.prefix.Bits())]
+	}
+	return false
+}
+
+func (s *prefixSet) containsIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && s.contains(addr)
+}
+
+// builtFrom reports whether the set was built from prefixes, and not from a
+// list that has since been replaced.
+func (s *prefixSet) builtFrom(prefixes []netip.Prefix) bool {
+	if s == nil || len(s.source) != len(prefixes) {
+		return false
+	}
+	return len(prefixes) == 0 || &s.source[0] == &prefixes[0]
+}
+
+// prefixesContain reports whether ip is in prefixes, looking it up in set
+// when set was built from them. Lists set on a Config by hand, or replaced
+// after Build, are scanned linearly so they are never ignored.
+func prefixesContain(set *prefixSet, prefixes []netip.Prefix, ip net.IP) bool {
+	if set.builtFrom(prefixes) {
+		return set.containsIP(ip)
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.IsValid() && normalizePrefix(prefix).Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePrefix masks prefix and turns ipv4-mapped ipv6 prefixes into ipv4
+// ones, matching how net.IPNet treats them.
+func normalizePrefix(prefix netip.Prefix) netip.Prefix {
+	addr := prefix.Addr()
+	if addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked()
+}
+
+func commonPrefixLen(a, b netip.Prefix) int {
+	x, y := a.Addr().AsSlice(), b.Addr().AsSlice()
+	limit := min(a.Bits(), b.Bits())
+
+	common := 0
+	for i := range x {
+		if x[i] != y[i] {
+			common += bits.LeadingZeros8(x[i] ^ y[i])
+			break
+		}
+		common += 8
+	}
+	return min(common, limit)
+}
+
+// addrBit returns the i-th most significant bit of addr.
+func addrBit(addr netip.Addr, i int) int {
+	var b byte
+	if addr.Is4() {
+		b = addr.As4()[i/8]
+	} else {
+		b = addr.As16()[i/8]
+	}
+	return int(b>>(7-i%8)) & 1
+}
+
+func ipNetToPrefix(ipNet net.IPNet) netip.Prefix {
+	addr, _ := netip.AddrFromSlice(ipNet.IP)
+	ones, _ := ipNet.Mask.Size()
+	if addr.Is4In6() && len(ipNet.Mask) == net.IPv4len {
+		addr = addr.Unmap()
+	}
+	return netip.PrefixFrom(addr, ones)
+}
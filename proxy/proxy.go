@@ -0,0 +1,315 @@
+// Package proxy implements an HTTP forward proxy enforcing a safeurl policy,
+// so services that aren't written in Go can get the same SSRF protection as
+// a safeurl.WrappedClient.
+//
+// Absolute-URI requests are sent with a safeurl.Transport and CONNECT tunnels
+// are opened with a SafeDialer, so every upstream request and tunnel is checked
+// against the policy of the client sending it.
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/doyensec/safeurl"
+)
+
+// values of Denial.Error
+const (
+	DenialPolicyViolation   = "policy_violation"
+	DenialProxyAuthRequired = "proxy_auth_required"
+	DenialBadRequest        = "bad_request"
+	DenialBadGateway        = "bad_gateway"
+)
+
+// Denial is the JSON body of the responses to requests the proxy refuses.
+type Denial struct {
+	Error string `json:"error"`
+	// rule that blocked the request and the offending value, set for
+	// policy violations
+	Rule    safeurl.Rule `json:"rule,omitempty"`
+	Value   string       `json:"value,omitempty"`
+	Message string       `json:"message"`
+}
+
+// User is a client of the proxy identified by Proxy-Authorization.
+type User struct {
+	Password string
+	// policy of the user, the policy of the listener is used when nil
+	Config *safeurl.Config
+}
+
+// Server is an HTTP forward proxy. The policy of a request is the one of the
+// authenticated user, if any, else the one of the listener it was received
+// on, else Default.
+type Server struct {
+	// policy used when neither the user nor the listener has one, the
+	// default safeurl policy when nil
+	Default *safeurl.Config
+
+	// when set, every request must authenticate as one of the users with
+	// Basic Proxy-Authorization, keyed by username
+	Users map[string]User
+
+	// a transport is built once per config, on first use
+	upstreams sync.Map
+}
+
+type upstream struct {
+	once   sync.Once
+	client *http.Client
+	// checks the urls of tunnels, its dialer opens them
+	validator *safeurl.WrappedClient
+	dialer    *safeurl.SafeDialer
+}
+
+var defaultConfig = sync.OnceValue(func() *safeurl.Config {
+	return safeurl.GetConfigBuilder().Build()
+})
+
+func New(config *safeurl.Config) *Server {
+	return &Server{Default: config}
+}
+
+// ServeHTTP serves requests with the Default policy.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, nil)
+}
+
+// Handler returns a handler enforcing config, for serving a listener with
+// its own policy. Users with a policy still get theirs.
+func (s *Server) Handler(config *safeurl.Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, config)
+	})
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, config *safeurl.Config) {
+	user, ok := s.authenticate(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="safeurl"`)
+		deny(w, http.StatusProxyAuthRequired, Denial{Error: DenialProxyAuthRequired, Message: "proxy authentication required"})
+		return
+	}
+
+	switch {
+	case user.Config != nil:
+		config = user.Config
+	case config == nil && s.Default != nil:
+		config = s.Default
+	case config == nil:
+		config = defaultConfig()
+	}
+	up := s.upstream(config)
+
+	if r.Method == http.MethodConnect {
+		s.tunnel(w, r, up)
+		return
+	}
+	s.forward(w, r, up)
+}
+
+func (s *Server) authenticate(r *http.Request) (User, bool) {
+	if s.Users == nil {
+		return User{}, true
+	}
+
+	username, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return User{}, false
+	}
+
+	user, ok := s.Users[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) != 1 {
+		return User{}, false
+	}
+	return user, true
+}
+
+func parseProxyAuthorization(header string) (username, password string, ok bool) {
+	scheme, credentials, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+func (s *Server) upstream(config *safeurl.Config) *upstream {
+	entry, ok := s.upstreams.Load(config)
+	if !ok {
+		entry, _ = s.upstreams.LoadOrStore(config, &upstream{})
+	}
+
+	up := entry.(*upstream)
+	up.once.Do(func() {
+		transport := safeurl.NewTransport(config)
+		up.client = &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+			// redirects are returned to the client, which sends the next
+			// request through the proxy
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		up.validator = transport.Client()
+		up.dialer = up.validator.Dialer()
+	})
+	return up
+}
+
+// forward sends an absolute-URI request upstream and copies the response
+// back.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, up *upstream) {
+	if !r.URL.IsAbs() {
+		deny(w, http.StatusBadRequest, Denial{Error: DenialBadRequest, Message: "request uri must be absolute"})
+		return
+	}
+
+	out, err := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), r.Body)
+	if err != nil {
+		deny(w, http.StatusBadRequest, Denial{Error: DenialBadRequest, Message: err.Error()})
+		return
+	}
+	out.ContentLength = r.ContentLength
+	copyHeader(out.Header, r.Header)
+
+	resp, err := up.client.Do(out)
+	if err != nil {
+		denyError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnel checks the target of a CONNECT request, dials it and pipes the
+// connections together.
+func (s *Server) tunnel(w http.ResponseWriter, r *http.Request, up *upstream) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		deny(w, http.StatusBadRequest, Denial{Error: DenialBadRequest, Message: "connect target must be host:port"})
+		return
+	}
+
+	// the host policy only applies to urls, tunnels are checked as https
+	// urls as that is what they are used for. Only the url checks run here,
+	// the addresses are resolved and checked once, by the dialer, like for
+	// forwarded requests
+	_, err = up.validator.NewRequestWithContext(r.Context(), http.MethodConnect, "https://"+net.JoinHostPort(host, port), nil)
+	if err != nil {
+		denyError(w, err)
+		return
+	}
+
+	target, err := up.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		denyError(w, err)
+		return
+	}
+
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		target.Close()
+		deny(w, http.StatusInternalServerError, Denial{Error: DenialBadGateway, Message: "connection can't be tunneled"})
+		return
+	}
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		target.Close()
+		return
+	}
+
+	// each side is half-closed when the other is done sending, so protocols
+	// that signal the end of a request with EOF keep receiving the response
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// bytes the client sent after the request are still buffered
+		if n := buf.Reader.Buffered(); n > 0 {
+			data, _ := buf.Reader.Peek(n)
+			target.Write(data)
+		}
+		io.Copy(target, conn)
+		closeWrite(target)
+	}()
+	io.Copy(conn, target)
+	closeWrite(conn)
+
+	<-done
+	conn.Close()
+	target.Close()
+}
+
+// closeWrite half-closes conn, or closes it when it can't be half-closed.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		return
+	}
+	conn.Close()
+}
+
+// hop-by-hop headers, which are not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = append([]string(nil), values...)
+	}
+
+	for _, field := range src.Values("Connection") {
+		for _, key := range strings.Split(field, ",") {
+			dst.Del(strings.TrimSpace(key))
+		}
+	}
+	for _, key := range hopHeaders {
+		dst.Del(key)
+	}
+}
+
+func denyError(w http.ResponseWriter, err error) {
+	var violation safeurl.PolicyViolation
+	if errors.As(err, &violation) {
+		deny(w, http.StatusForbidden, Denial{
+			Error:   DenialPolicyViolation,
+			Rule:    violation.Rule(),
+			Value:   violation.Value(),
+			Message: violation.Error(),
+		})
+		return
+	}
+	deny(w, http.StatusBadGateway, Denial{Error: DenialBadGateway, Message: err.Error()})
+}
+
+func deny(w http.ResponseWriter, status int, denial Denial) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(denial)
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/doyensec/safeurl"
+)
+
+func proxyClient(proxySrv *httptest.Server, user *url.Userinfo) *http.Client {
+	proxyURL, _ := url.Parse(proxySrv.URL)
+	proxyURL.User = user
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+func readDenial(t *testing.T, resp *http.Response) Denial {
+	t.Helper()
+	defer resp.Body.Close()
+
+	var denial Denial
+	err := json.NewDecoder(resp.Body).Decode(&denial)
+	if err != nil {
+		t.Errorf("proxy returned invalid denial: %v", err)
+	}
+	return denial
+}
+
+func TestForwardProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("proxy forwarded Proxy-Authorization")
+		}
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/", http.StatusFound)
+			return
+		}
+		fmt.Fprintf(w, "%v %v", r.URL.Path, r.Header.Get("X-Test"))
+	}))
+	defer upstream.Close()
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	porti, _ := strconv.Atoi(port)
+
+	allowed := safeurl.GetConfigBuilder().
+		SetAllowedPorts(porti).
+		SetAllowedIPs("127.0.0.1").
+		Build()
+
+	server := &Server{
+		Users: map[string]User{
+			"alice": {Password: "secret", Config: allowed},
+			// gets the default policy, blocking private networks
+			"bob": {Password: "hunter2"},
+		},
+	}
+	proxySrv := httptest.NewServer(server)
+	defer proxySrv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/path", nil)
+	req.Header.Set("X-Test", "header")
+
+	resp, err := proxyClient(proxySrv, url.UserPassword("alice", "secret")).Do(req)
+	if err != nil {
+		t.Fatalf("proxy returned error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "/path header" {
+		t.Errorf("proxy returned incorrect response: %v %q", resp.StatusCode, body)
+	}
+
+	// redirects are returned to the client, which sends the next request
+	// through the proxy again
+	client := proxyClient(proxySrv, url.UserPassword("alice", "secret"))
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err = client.Get(upstream.URL + "/redirect")
+	if err != nil {
+		t.Fatalf("proxy returned error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("proxy returned incorrect status for a redirect: %v", resp.StatusCode)
+	}
+
+	resp, err = proxyClient(proxySrv, url.UserPassword("bob", "hunter2")).Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("proxy returned error: %v", err)
+	}
+	denial := readDenial(t, resp)
+	if resp.StatusCode != http.StatusForbidden || denial.Error != DenialPolicyViolation || denial.Rule != safeurl.RuleAllowedPorts || denial.Value != port {
+		t.Errorf("proxy returned incorrect denial: %v %+v", resp.StatusCode, denial)
+	}
+
+	for _, user := range []*url.Userinfo{nil, url.UserPassword("alice", "wrong"), url.UserPassword("mallory", "secret")} {
+		resp, err = proxyClient(proxySrv, user).Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("proxy returned error: %v", err)
+		}
+		denial = readDenial(t, resp)
+		if resp.StatusCode != http.StatusProxyAuthRequired || denial.Error != DenialProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("proxy returned incorrect response for %v: %v %+v", user, resp.StatusCode, denial)
+		}
+	}
+}
+
+// countingResolver resolves every host to addrs and counts the lookups.
+type countingResolver struct {
+	addrs   []string
+	lookups atomic.Int32
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups.Add(1)
+
+	var addrs []net.IPAddr
+	for _, ip := range r.addrs {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestConnectProxy(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "tunneled")
+	}))
+	defer upstream.Close()
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	porti, _ := strconv.Atoi(port)
+
+	allowed := safeurl.GetConfigBuilder().
+		SetAllowedPorts(porti).
+		SetAllowedIPs("127.0.0.1").
+		SetBlockedHosts("blocked.test").
+		Build()
+
+	// the policy is selected by listener
+	server := &Server{}
+	proxySrv := httptest.NewServer(server.Handler(allowed))
+	defer proxySrv.Close()
+	defaultSrv := httptest.NewServer(server)
+	defer defaultSrv.Close()
+
+	resp, err := proxyClient(proxySrv, nil).Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("proxy returned error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "tunneled" {
+		t.Errorf("proxy returned incorrect body: %q", body)
+	}
+
+	tests := []struct {
+		proxySrv *httptest.Server
+		target   string
+		rule     safeurl.Rule
+	}{
+		{proxySrv, "127.0.0.2:" + port, safeurl.RuleAllowedIPs},
+		{proxySrv, "blocked.test:" + port, safeurl.RuleBlockedHosts},
+		{defaultSrv, "127.0.0.1:443", safeurl.RulePrivateNetworks},
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", test.proxySrv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", test.target, test.target)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatalf("proxy returned error: %v", err)
+		}
+
+		denial := readDenial(t, resp)
+		if resp.StatusCode != http.StatusForbidden || denial.Rule != test.rule {
+			t.Errorf("proxy returned incorrect denial for %v: %v %+v", test.target, resp.StatusCode, denial)
+		}
+		conn.Close()
+	}
+
+	// like forwarded requests, tunnels skip the blocked addresses of a host
+	// and resolve it once
+	resolver := &countingResolver{addrs: []string{"127.0.0.2", "127.0.0.1"}}
+	mixedSrv := httptest.NewServer(server.Handler(safeurl.GetConfigBuilder().
+		SetAllowedPorts(porti).
+		SetAllowedIPs("127.0.0.1").
+		SetResolver(resolver).
+		Build()))
+	defer mixedSrv.Close()
+
+	conn, err := net.Dial("tcp", mixedSrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT mixed.test:%v HTTP/1.1\r\nHost: mixed.test:%v\r\n\r\n", port, port)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("proxy returned incorrect response for a host with a blocked address: %v", err)
+	}
+	if lookups := resolver.lookups.Load(); lookups != 1 {
+		t.Errorf("expected a single lookup, got: %v", lookups)
+	}
+}
+
+func TestConnectHalfClose(t *testing.T) {
+	// answers once the client is done sending
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		data, _ := io.ReadAll(conn)
+		conn.Write(append(data, " pong"...))
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	porti, _ := strconv.Atoi(port)
+
+	allowed := safeurl.GetConfigBuilder().
+		SetAllowedPorts(porti).
+		SetAllowedIPs("127.0.0.1").
+		Build()
+
+	proxySrv := httptest.NewServer(New(allowed))
+	defer proxySrv.Close()
+
+	conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	target := ln.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("proxy returned incorrect response: %v", err)
+	}
+
+	conn.Write([]byte("ping"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	body, err := io.ReadAll(br)
+	if err != nil || string(body) != "ping pong" {
+		t.Errorf("tunnel returned incorrect body: %q %v", body, err)
+	}
+}
+
+func TestUpstreamShared(t *testing.T) {
+	config := safeurl.GetConfigBuilder().Build()
+	server := &Server{}
+
+	up := server.upstream(config)
+	if server.upstream(config) != up {
+		t.Errorf("proxy built the upstream of a config twice")
+	}
+
+	// tunnels and forwarded requests use the same client and dialer
+	transport, ok := up.client.Transport.(*safeurl.Transport)
+	if !ok || transport.Client() != up.validator || up.validator.Dialer() != up.dialer {
+		t.Errorf("proxy built more than one stack for a config")
+	}
+}
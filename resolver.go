@@ -0,0 +1,64 @@
+package safeurl
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Resolver looks up the addresses of a host. *net.Resolver implements it,
+// other implementations can be used to query a specific upstream, apply
+// split-horizon rules or serve answers from memory in tests.
+//
+// The addresses returned are the ones dialed and checked against the policy,
+// no second lookup is made.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// TTLResolver is implemented by resolvers that report how long their answers
+// can be cached for. DNSCache uses it to honor the record ttls.
+type TTLResolver interface {
+	Resolver
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+func buildResolver(config *Config) Resolver {
+	if config.Resolver != nil {
+		return config.Resolver
+	}
+
+	if !config.InTestMode {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "udp", "localhost:8053")
+		},
+	}
+}
+
+func resolveHost(ctx context.Context, host string, resolver Resolver) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+
+	return ips, nil
+}
@@ -0,0 +1,244 @@
+package safeurl
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultEncryptedResolverTimeout = 5 * time.Second
+
+// DoTResolver resolves hosts using DNS-over-TLS (RFC 7858).
+//
+// Connections to the upstream servers are made with a plain net.Dialer to the
+// pinned addresses and are not subject to the policy. The answers are still
+// checked against the policy when they are dialed.
+type DoTResolver struct {
+	// "ip:port" addresses of the upstream servers, tried in order
+	Servers []string
+	// used to verify the upstream servers, ServerName must match their
+	// certificate
+	TLSConfig *tls.Config
+	// timeout of a single exchange with an upstream server
+	Timeout time.Duration
+}
+
+// NewDoTResolver returns a DoTResolver querying the pinned servers and
+// verifying their certificates against serverName.
+func NewDoTResolver(serverName string, servers ...string) *DoTResolver {
+	return &DoTResolver{
+		Servers:   servers,
+		TLSConfig: &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12},
+		Timeout:   defaultEncryptedResolverTimeout,
+	}
+}
+
+func (r *DoTResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := lookupIPAddr(ctx, host, r.exchange)
+	return addrs, err
+}
+
+func (r *DoTResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	return lookupIPAddr(ctx, host, r.exchange)
+}
+
+func (r *DoTResolver) exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: r.TLSConfig,
+		Timeout:   r.Timeout,
+	}
+
+	var firstErr error
+	for _, server := range r.Servers {
+		resp, _, err := client.ExchangeContext(ctx, query, server)
+		if err == nil {
+			return resp, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = errors.New("no dns-over-tls servers configured")
+	}
+	return nil, firstErr
+}
+
+// DoHResolver resolves hosts using DNS-over-HTTPS (RFC 8484).
+//
+// The host of URL is never resolved, connections are made with a plain
+// net.Dialer to the pinned Servers and are not subject to the policy. The
+// answers are still checked against the policy when they are dialed.
+type DoHResolver struct {
+	// url of the dns query endpoint, e.g. https://dns.google/dns-query
+	URL string
+	// "ip:port" addresses the URL is served from, tried in order
+	Servers []string
+	// used to verify the upstream servers, ServerName defaults to the host
+	// of URL
+	TLSConfig *tls.Config
+	// timeout of a single exchange with an upstream server
+	Timeout time.Duration
+
+	clientOnce sync.Once
+	client     *http.Client
+}
+
+// NewDoHResolver returns a DoHResolver sending queries to url through the
+// pinned servers.
+func NewDoHResolver(url string, servers ...string) *DoHResolver {
+	return &DoHResolver{
+		URL:       url,
+		Servers:   servers,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+		Timeout:   defaultEncryptedResolverTimeout,
+	}
+}
+
+func (r *DoHResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := lookupIPAddr(ctx, host, r.exchange)
+	return addrs, err
+}
+
+func (r *DoHResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	return lookupIPAddr(ctx, host, r.exchange)
+}
+
+func (r *DoHResolver) httpClient() *http.Client {
+	r.clientOnce.Do(r.buildHTTPClient)
+	return r.client
+}
+
+func (r *DoHResolver) buildHTTPClient() {
+	dialer := &net.Dialer{}
+	r.client = &http.Client{
+		Timeout: r.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   r.TLSConfig,
+			ForceAttemptHTTP2: true,
+			// ignore the address derived from URL and only ever connect to
+			// the pinned servers
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var firstErr error
+				for _, server := range r.Servers {
+					conn, err := dialer.DialContext(ctx, network, server)
+					if err == nil {
+						return conn, nil
+					}
+					if firstErr == nil {
+						firstErr = err
+					}
+				}
+				if firstErr == nil {
+					firstErr = errors.New("no dns-over-https servers configured")
+				}
+				return nil, firstErr
+			},
+		},
+	}
+}
+
+func (r *DoHResolver) exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 section 4.1: use an id of 0 to make responses cache friendly
+	query.Id = 0
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.URL, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns-over-https server returned status: %v", resp.Status)
+	}
+
+	// a dns message can't be larger than 64KiB
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	answer := new(dns.Msg)
+	err = answer.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return answer, nil
+}
+
+// lookupIPAddr queries the A and AAAA records of host using exchange. The
+// returned ttl is the lowest ttl of the answers.
+func lookupIPAddr(ctx context.Context, host string, exchange func(context.Context, *dns.Msg) (*dns.Msg, error)) ([]net.IPAddr, time.Duration, error) {
+	var addrs []net.IPAddr
+	var lastErr error
+	var ttl uint32
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		query := new(dns.Msg)
+		query.SetQuestion(dns.Fqdn(host), qtype)
+
+		resp, err := exchange(ctx, query)
+		if err != nil {
+			lastErr = &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true}
+			continue
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		default:
+			lastErr = &net.DNSError{Err: dns.RcodeToString[resp.Rcode], Name: host}
+			continue
+		}
+
+		for _, rr := range resp.Answer {
+			switch record := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.IPAddr{IP: record.A})
+			case *dns.AAAA:
+				addrs = append(addrs, net.IPAddr{IP: record.AAAA})
+			default:
+				continue
+			}
+			if len(addrs) == 1 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+
+	if len(addrs) > 0 {
+		return addrs, time.Duration(ttl) * time.Second, nil
+	}
+	if lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
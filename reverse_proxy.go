@@ -0,0 +1,49 @@
+package safeurl
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+)
+
+type ReverseProxyOptions struct {
+	// 4xx or 5xx status of the responses to requests blocked by the policy,
+	// 403 otherwise
+	ViolationStatusCode int
+}
+
+// NewReverseProxy returns an httputil.ReverseProxy enforcing config. The
+// target set by rewrite is checked with the scheme, host and credentials
+// checks of WrappedClient.Do and is connected to with the client's dialer,
+// so it is safe to proxy to user controlled origins. The transport of the
+// proxy is a Transport.
+//
+// Requests blocked by the policy are answered with
+// options.ViolationStatusCode, other upstream errors with 502. Redirects are
+// returned to the caller as is.
+func NewReverseProxy(config *Config, rewrite func(*httputil.ProxyRequest), options ReverseProxyOptions) *httputil.ReverseProxy {
+	transport := NewTransport(config)
+	wc := transport.wc
+
+	violationStatus := options.ViolationStatusCode
+	if violationStatus < 400 || violationStatus > 599 {
+		violationStatus = http.StatusForbidden
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite:   rewrite,
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status := http.StatusBadGateway
+
+			var violation PolicyViolation
+			if errors.As(err, &violation) {
+				status = violationStatus
+			} else {
+				logError(r.Context(), wc.logger, "reverse proxy request failed", err)
+			}
+
+			http.Error(w, http.StatusText(status), status)
+		},
+	}
+}
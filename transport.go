@@ -0,0 +1,86 @@
+package safeurl
+
+import (
+	"net/http"
+)
+
+// Transport is an http.RoundTripper enforcing a Config. Every request, and
+// every redirect an http.Client follows with it, goes through the scheme,
+// host and credentials checks of WrappedClient.Do and is dialed with a
+// SafeDialer, so it can be handed to SDKs that only accept an
+// http.RoundTripper or an *http.Client:
+//
+//	httpClient := &http.Client{Transport: safeurl.NewTransport(config)}
+//
+// Redirect limits are left to the http.Client using the Transport.
+type Transport struct {
+	wc *WrappedClient
+}
+
+func NewTransport(config *Config) *Transport {
+	return &Transport{wc: Client(config)}
+}
+
+// Client returns the client whose checks and dialer the transport uses.
+func (t *Transport) Client() *WrappedClient {
+	return t.wc
+}
+
+// Config returns the policy currently enforced by the transport.
+func (t *Transport) Config() *Config {
+	return t.wc.Config()
+}
+
+// SetConfig replaces the policy of the transport, see
+// WrappedClient.SetConfig.
+func (t *Transport) SetConfig(config *Config) {
+	t.wc.SetConfig(config)
+}
+
+// RoundTrip checks the url of req and sends it. The response limits of the
+// config apply to the response.
+func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	req = req.WithContext(withRequestState(req.Context()))
+
+	config := t.wc.Config()
+	if config.Metrics != nil {
+		defer func() {
+			recordRequest(config.Metrics, config, err)
+		}()
+	}
+
+	// http.Client links a redirected request to the response that caused it
+	hop := 0
+	for via := req.Response; via != nil && via.Request != nil; via = via.Request.Response {
+		hop++
+	}
+
+	state := getRequestState(req.Context())
+	state.setHop(hop)
+	state.setURL(req.URL.Redacted())
+
+	err = validateURL(req.Context(), req.URL, config, t.wc.logger)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		if hop > 0 {
+			setViolationHop(err, hop)
+			return nil, &RedirectError{hop: hop, url: req.URL.Redacted(), err: err}
+		}
+		return nil, err
+	}
+
+	req = prepareLimitedRequest(req, config)
+
+	resp, err = t.wc.Client.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, wrapHeaderLimitError(err, config)
+	}
+
+	return limitResponse(resp, config)
+}
+
+func (t *Transport) CloseIdleConnections() {
+	t.wc.CloseIdleConnections()
+}
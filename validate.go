@@ -0,0 +1,133 @@
+package safeurl
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	urllib "net/url"
+	"strconv"
+	"strings"
+)
+
+// Rule identifies the part of the policy that allowed or blocked a target.
+type Rule string
+
+const (
+	RuleCredentials        Rule = "credentials"
+	RuleAllowedSchemes     Rule = "allowed_schemes"
+	RuleAllowedHosts       Rule = "allowed_hosts"
+	RuleBlockedHosts       Rule = "blocked_hosts"
+	RuleInvalidHost        Rule = "invalid_host"
+	RuleIPv6               Rule = "ipv6"
+	RuleAllowedPorts       Rule = "allowed_ports"
+	RuleBlockedPorts       Rule = "blocked_ports"
+	RuleAllowedSchemePorts Rule = "allowed_scheme_ports"
+	RuleNetwork            Rule = "network"
+	RuleInvalidAddress     Rule = "invalid_address"
+	RuleAllowedIPs         Rule = "allowed_ips"
+	RuleBlockedIPs         Rule = "blocked_ips"
+	RulePrivateNetworks    Rule = "private_networks"
+	// no rule matched the address and it was allowed
+	RuleDefault Rule = "default"
+)
+
+// Verdict is the outcome of validating a URL without sending a request.
+type Verdict struct {
+	URL  string
+	Host string
+	Port string
+
+	// one entry per address the host resolved to
+	Addresses []AddressVerdict
+}
+
+// Allowed reports whether every resolved address passed the policy.
+func (v *Verdict) Allowed() bool {
+	for _, addr := range v.Addresses {
+		if !addr.Allowed {
+			return false
+		}
+	}
+	return len(v.Addresses) > 0
+}
+
+type AddressVerdict struct {
+	IP      net.IP
+	Allowed bool
+	Rule    Rule
+	Err     error
+}
+
+// Validate runs the same checks as Do and the dialer against rawURL without
+// connecting to it. The host is resolved with the client's resolver and each
+// address is checked against the ip, port and ipv6 policy.
+//
+// A non-nil error is returned when the url itself is rejected, the host can't
+// be resolved or any of the resolved addresses is blocked. Since a request
+// may be served by any of the addresses, a single blocked address is enough
+// to reject the url.
+func (wc *WrappedClient) Validate(ctx context.Context, rawURL string) (*Verdict, error) {
+	parsed, err := urllib.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	wc.logger.DebugContext(ctx, "validating url", slog.String(LogKeyURL, parsed.Redacted()))
+
+	config := wc.Config()
+	err = validateURL(ctx, parsed, config, wc.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := portForURL(parsed, config)
+	if err != nil {
+		return nil, err
+	}
+
+	verdict := &Verdict{
+		URL:  parsed.Redacted(),
+		Host: parsed.Hostname(),
+		Port: port,
+	}
+
+	ips, err := resolveHost(ctx, verdict.Host, wc.resolver)
+	if err != nil {
+		logError(ctx, wc.logger, "failed to resolve host", err, slog.String(LogKeyHost, verdict.Host))
+		return verdict, err
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		rule, err := checkAddress(ctx, ipNetwork("tcp", ip), ip, port, config, wc.logger)
+		verdict.Addresses = append(verdict.Addresses, AddressVerdict{
+			IP:      ip,
+			Allowed: err == nil,
+			Rule:    rule,
+			Err:     err,
+		})
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return verdict, firstErr
+}
+
+func portForURL(parsed *urllib.URL, config *Config) (string, error) {
+	if port := parsed.Port(); port != "" {
+		return port, nil
+	}
+
+	if port, ok := config.SchemeDefaultPorts[strings.ToLower(parsed.Scheme)]; ok {
+		return strconv.Itoa(port), nil
+	}
+
+	port, err := net.LookupPort("tcp", parsed.Scheme)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.Itoa(port), nil
+}